@@ -0,0 +1,207 @@
+package wsmux
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendData transmits a msgDAT frame at the given stream priority.  If write
+// batching is enabled, the data is instead queued in order with other batched
+// data, and is coalesced with any queued data for the same stream, up to the
+// maximum frame size.
+func (s *Session) sendData(f frame, priority uint8) error {
+	if !s.batchWrites {
+		return s.sendAt(f, int(priority))
+	}
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	// the caller may reuse its buffer, so the payload is always copied
+	if n := len(s.batch); n > 0 && s.batch[n-1].msg == msgDAT && s.batch[n-1].id == f.id &&
+		len(s.batch[n-1].payload)+len(f.payload) <= s.maxFrameSize {
+		s.batch[n-1].payload = append(s.batch[n-1].payload, f.payload...)
+	} else {
+		f.payload = append([]byte(nil), f.payload...)
+		s.batch = append(s.batch, f)
+	}
+	s.batchBytes += len(f.payload)
+
+	if s.batchBytes >= s.batchSize {
+		return s.flushLocked()
+	}
+	return nil
+}
+
+// Flush writes any data queued by write batching to the websocket
+// connection.  This is a no-op if batching is not enabled.
+func (s *Session) Flush() error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked writes queued frames, as few websocket messages as the maximum
+// frame size allows.  The caller must hold sendLock.  If a write fails, the
+// remaining queued frames are discarded.
+func (s *Session) flushLocked() error {
+	batch := s.batch
+	s.batch = nil
+	s.batchBytes = 0
+	for len(batch) > 0 {
+		n := s.batchMessageFrames(batch)
+		var err error
+		if n == 1 {
+			err = s.writeFrame(batch[0])
+		} else {
+			err = s.writeBatch(batch[:n])
+		}
+		if err != nil {
+			return err
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+// batchMessageFrames returns the number of frames from the start of batch
+// which fit in a single msgBAT message no larger than the maximum frame size.
+// This is always at least one.
+func (s *Session) batchMessageFrames(batch []frame) int {
+	size := 0
+	for i, f := range batch {
+		size += 4 + HEADER_SIZE + len(f.payload)
+		if i > 0 && size > s.maxFrameSize {
+			return i
+		}
+	}
+	return len(batch)
+}
+
+// writeBatch writes several frames to the websocket connection in a single
+// msgBAT message.  Like writeFrame, it aborts the session if the write fails.
+// The caller must hold sendLock.
+func (s *Session) writeBatch(frames []frame) error {
+	if s.connReleased {
+		return ErrSessionClosed
+	}
+	for _, f := range frames {
+		if err := s.intercept(Outbound, f); err != nil {
+			s.logger.forStream(f.id).Infof("frame rejected by interceptor: %v", err)
+			return err
+		}
+	}
+	if err := s.setWriteDeadline(); err != nil {
+		return err
+	}
+
+	typ := websocket.BinaryMessage
+	if s.textMessages {
+		typ = websocket.TextMessage
+	}
+	mw, err := s.conn.NextWriter(typ)
+	if err != nil && s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if err != nil {
+		s.logger.Errorf("error writing batch of %d frames: %v", len(frames), err)
+		err = fmt.Errorf("wsmux: writing batch of %d frames: %w", len(frames), err)
+		s.abortAsync(err)
+		return err
+	}
+
+	var w io.Writer = mw
+	var enc io.WriteCloser
+	if s.textMessages {
+		enc = base64.NewEncoder(base64.StdEncoding, mw)
+		w = enc
+	}
+	write := func(b []byte) {
+		if err == nil {
+			_, err = w.Write(b)
+		}
+	}
+	write(newHeader(msgBAT, 0))
+	var length [4]byte
+	for _, f := range frames {
+		binary.LittleEndian.PutUint32(length[:], uint32(HEADER_SIZE+len(f.payload)))
+		write(length[:])
+		write(newHeader(f.msg, f.id))
+		write(f.payload)
+	}
+	if enc != nil {
+		if e := enc.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := mw.Close(); err == nil {
+		err = e
+	}
+	if err != nil && s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if err != nil {
+		s.logger.Errorf("error writing batch of %d frames: %v", len(frames), err)
+		err = fmt.Errorf("wsmux: writing batch of %d frames: %w", len(frames), err)
+		s.abortAsync(err)
+		return err
+	}
+
+	for _, f := range frames {
+		countFrame(&s.stats.framesSent, &s.stats.bytesSent, f)
+	}
+	return nil
+}
+
+// handleBatch handles the frames contained in a msgBAT message, following its
+// header.  Frames after any malformed length are discarded.
+func (s *Session) handleBatch(data []byte) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			s.logger.Errorf("discarding batch: %v", ErrMalformedFrame)
+			s.protocolViolation(ErrMalformedFrame)
+			return
+		}
+		n := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if uint64(n) > uint64(len(data)) {
+			s.logger.Errorf("discarding batch: %v", ErrMalformedFrame)
+			s.protocolViolation(ErrMalformedFrame)
+			return
+		}
+		msg := data[:n]
+		data = data[n:]
+		if len(msg) > 0 && msg[0] == msgBAT {
+			s.logger.Errorf("discarding nested batch: %v", ErrMalformedFrame)
+			s.protocolViolation(ErrMalformedFrame)
+			continue
+		}
+		s.handleMessage(msg)
+	}
+}
+
+// flushBatches periodically flushes queued data, aborting the session if
+// that fails.
+func (s *Session) flushBatches() {
+	ticker := s.clock.NewTicker(s.batchFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C():
+			if err := s.Flush(); err != nil {
+				s.abort(err)
+				return
+			}
+		}
+	}
+}
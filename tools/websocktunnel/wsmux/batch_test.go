@@ -0,0 +1,175 @@
+package wsmux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+func TestBatchMessage(t *testing.T) {
+	messages := make(chan []byte, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		for i := 0; i < 3; i++ {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			syn, err := deserializeFrame(msg)
+			if err != nil || syn.msg != msgSYN {
+				return
+			}
+			_ = conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, DefaultCapacity).serialize())
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		messages <- msg
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), BatchWrites: true, BatchFlushInterval: time.Hour})
+	defer session.Close()
+	// sending any other frame flushes the batch, so all streams are opened
+	// before writing
+	var streams []Stream
+	for i := 0; i < 3; i++ {
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, str)
+	}
+	for i, str := range streams {
+		if _, err := str.Write([]byte{'a' + byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the three DAT frames are sent in a single message
+	msg := <-messages
+	if header(msg[:HEADER_SIZE]).msg() != msgBAT {
+		t.Fatalf("expected a batch message, got %v", msg)
+	}
+	data := msg[HEADER_SIZE:]
+	for i := 0; i < 3; i++ {
+		n := binary.LittleEndian.Uint32(data)
+		fr, err := deserializeFrame(data[4 : 4+n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.msg != msgDAT || fr.id != uint32(2*i+1) || !bytes.Equal(fr.payload, []byte{'a' + byte(i)}) {
+			t.Fatalf("unexpected frame %d in batch: %v", i, fr)
+		}
+		data = data[4+n:]
+	}
+	if len(data) != 0 {
+		t.Fatalf("unexpected trailing data in batch: %v", data)
+	}
+	if dat := session.Stats().FramesSent.DAT; dat != 3 {
+		t.Fatalf("expected 3 DAT frames to be counted, got %d", dat)
+	}
+}
+
+func TestBatchMessagesEcho(t *testing.T) {
+	for _, text := range []bool{false, true} {
+		t.Run(fmt.Sprintf("text=%v", text), func(t *testing.T) {
+			conf := Config{
+				Log:                genLogger(),
+				BatchWrites:        true,
+				BatchFlushInterval: time.Millisecond,
+				TextMessages:       text,
+				MaxFrameSize:       64,
+			}
+			server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+				session := Server(conn, conf)
+				for {
+					str, err := session.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						b := new(bytes.Buffer)
+						_, _ = io.Copy(b, str)
+						_, _ = io.Copy(str, b)
+						_ = str.Close()
+					}()
+				}
+			}))
+			defer server.Close()
+
+			session, err := Dial(context.Background(), util.MakeWsURL(server.URL), conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					msg := bytes.Repeat([]byte{byte(i)}, 500)
+					str, err := session.Open()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := str.Write(msg); err != nil {
+						t.Error(err)
+						return
+					}
+					if err := str.CloseWrite(); err != nil {
+						t.Error(err)
+						return
+					}
+					final := new(bytes.Buffer)
+					if _, err := io.Copy(final, str); err != nil {
+						t.Error(err)
+						return
+					}
+					if !bytes.Equal(final.Bytes(), msg) {
+						t.Errorf("stream %d: bad message", i)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandleBatchMalformed(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	// a truncated length, and a length exceeding the message, are discarded
+	// without panicking
+	session.handleMessage(append(newHeader(msgBAT, 0), 1, 0))
+	session.handleMessage(append(newHeader(msgBAT, 0), 100, 0, 0, 0, msgFIN))
+	if session.IsClosed() {
+		t.Fatal("session should remain open")
+	}
+}
@@ -155,3 +155,104 @@ func BenchmarkMultiTransfer(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+// measure the receive path, with one DAT frame per iteration
+func BenchmarkRecvLoopThroughput(b *testing.B) {
+	const frameSize = 4 * 1024
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		session := Server(conn, Config{StreamBufferSize: 64 * 1024})
+		str, err := session.Accept()
+		if err != nil {
+			panic(err)
+		}
+		_, _ = io.Copy(ioutil.Discard, str)
+		close(done)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := Client(conn, Config{StreamBufferSize: 64 * 1024, MaxFrameSize: frameSize})
+	defer client.Close()
+	str, err := client.Open()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, frameSize)
+	b.SetBytes(frameSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := str.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := str.Close(); err != nil {
+		b.Fatal(err)
+	}
+	<-done
+}
+
+// measure opening, using and closing many short-lived streams, with and
+// without Config.ReuseBuffers
+func BenchmarkStreamChurn(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		name := "Allocate"
+		if reuse {
+			name = "ReuseBuffers"
+		}
+		b.Run(name, func(b *testing.B) {
+			conf := Config{StreamBufferSize: 64 * 1024, ReuseBuffers: reuse}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				session := Server(conn, conf)
+				for {
+					str, err := session.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						_, _ = io.Copy(str, str)
+						_ = str.Close()
+					}()
+				}
+			}))
+			defer server.Close()
+			conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			client := Client(conn, conf)
+			defer client.Close()
+
+			msg := []byte("hello")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				str, err := client.Open()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := str.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if err := str.Close(); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, str); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -60,6 +60,11 @@ func (b *buffer) Read(buf []byte) (int, error) {
 
 // Write to buffer
 func (b *buffer) Write(buf []byte) (int, error) {
+	// an empty write must not change the buffer, since with start == end
+	// it would otherwise mark an empty buffer as full
+	if len(buf) == 0 {
+		return 0, nil
+	}
 	// we have more bytes than we can write then error
 	if len(buf) > b.spare() {
 		return 0, ErrNoCapacity
@@ -71,3 +71,16 @@ func TestCircularBuffer(t *testing.T) {
 		t.Fatal("buffer should be full")
 	}
 }
+
+func TestCircularBufferEmptyWrite(t *testing.T) {
+	b := newBuffer(8)
+	if n, err := b.Write(nil); n != 0 || err != nil {
+		t.Fatalf("empty write returned %d, %v", n, err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("empty write left %d bytes in the buffer", b.Len())
+	}
+	if _, err := b.Write([]byte{1, 2}); err != nil {
+		t.Fatalf("write after an empty write failed: %v", err)
+	}
+}
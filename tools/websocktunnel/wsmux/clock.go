@@ -0,0 +1,63 @@
+package wsmux
+
+import (
+	"time"
+)
+
+// clock is the source of time for a session's timeouts and intervals.  It
+// allows tests to replace the real clock with a fake one.  Deadlines on the
+// underlying websocket connection and stream deadlines set by callers always
+// use real time.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+	NewTicker(d time.Duration) ticker
+}
+
+// timer is the subset of *time.Timer used by sessions
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// ticker is the subset of *time.Ticker used by sessions
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock implements clock using the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,186 @@
+package wsmux
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+// fakeClock is a clock which only advances when told to
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// fakeTimer implements timer, and ticker via fakeTicker; tickers have a
+// nonzero period
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	period   time.Duration
+	stopped  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	return c.add(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), deadline: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, t)
+	return t
+}
+
+// Advance moves the clock forward, firing any timers and tickers which are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, t := range c.waiters {
+		if t.stopped {
+			continue
+		}
+		if !t.deadline.After(c.now) {
+			select {
+			case t.c <- c.now:
+			default:
+			}
+			if t.period == 0 {
+				continue
+			}
+			t.deadline = c.now.Add(t.period)
+		}
+		waiters = append(waiters, t)
+	}
+	c.waiters = waiters
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+// fakeTicker adapts fakeTimer to the ticker interface
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// advanceUntil advances the clock by d, repeatedly, until done is closed
+func advanceUntil(t *testing.T, clock *fakeClock, d time.Duration, done <-chan struct{}) {
+	for i := 0; i < 100; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(d)
+		}
+	}
+	t.Fatal("timed out advancing the fake clock")
+}
+
+func TestAcceptDeadlineFakeClock(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	session := Client(conn, Config{StreamAcceptDeadline: time.Hour, Log: genLogger(), clock: clock})
+	defer session.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := session.Open(); err != ErrAcceptTimeout {
+			t.Errorf("expected ErrAcceptTimeout, got %v", err)
+		}
+	}()
+	advanceUntil(t, clock, time.Hour, done)
+}
+
+func TestKeepAliveExpiresFakeClock(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, silentConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	session := Client(conn, Config{KeepAliveInterval: time.Hour, Log: genLogger(), clock: clock})
+	defer session.Close()
+
+	advanceUntil(t, clock, time.Hour, session.closed)
+}
+
+func TestAcceptDeadlineDisabledFakeClock(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	session := Client(conn, Config{StreamAcceptDeadline: -1, Log: genLogger(), clock: clock})
+	defer session.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := session.Open(); err != ErrSessionClosed {
+			t.Errorf("expected ErrSessionClosed, got %v", err)
+		}
+	}()
+
+	// well past the default deadline, Open is still waiting
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		clock.Advance(time.Hour)
+	}
+	select {
+	case <-done:
+		t.Fatal("Open returned without a deadline")
+	default:
+	}
+
+	_ = session.Close()
+	<-done
+}
@@ -2,21 +2,85 @@ package wsmux
 
 import (
 	"errors"
+	"strconv"
 )
 
+// netError is an error which implements net.Error, so that callers treating
+// streams as a net.Conn can recognize timeouts.
+type netError struct {
+	errString string
+	timeout   bool
+	temporary bool
+}
+
+func (e netError) Error() string {
+	return e.errString
+}
+
+func (e netError) Timeout() bool {
+	return e.timeout
+}
+
+func (e netError) Temporary() bool {
+	return e.temporary
+}
+
+// ProtocolError describes a violation of the wsmux protocol by the remote
+// end.  These are passed to Config.OnProtocolError, and a session closed
+// because of one under Config.StrictProtocol fails with it.  Use errors.Is to
+// match the Kind, for example:
+//
+//	if errors.Is(err, wsmux.ErrWindowExceeded) { ... }
+type ProtocolError struct {
+	// Kind is the sentinel error for the kind of violation, such as
+	// ErrMalformedFrame or ErrDuplicateStream
+	Kind error
+
+	// StreamID is the ID of the stream affected by the violation; it is only
+	// meaningful if HasStreamID is true, since some violations, such as a
+	// malformed frame, cannot be attributed to a stream
+	StreamID    uint32
+	HasStreamID bool
+}
+
+func (e *ProtocolError) Error() string {
+	if e.HasStreamID {
+		return "protocol error on stream " + strconv.FormatUint(uint64(e.StreamID), 10) + ": " + e.Kind.Error()
+	}
+	return "protocol error: " + e.Kind.Error()
+}
+
+// Unwrap returns the Kind, so that errors.Is matches it
+func (e *ProtocolError) Unwrap() error {
+	return e.Kind
+}
+
 var (
 
-	// ErrAcceptTimeout is returned when the Accept operation times out
-	ErrAcceptTimeout = errors.New("accept timed out")
+	// ErrAcceptTimeout is returned from Open when the remote end does not
+	// accept the stream within the accept deadline.  This implements
+	// net.Error, and its Timeout method returns true.
+	ErrAcceptTimeout error = netError{errString: "accept timed out", timeout: true, temporary: true}
 
-	// ErrBrokenPipe is returned when data cannot be written to or read from a stream
+	// ErrBrokenPipe was returned when data could not be written to or read
+	// from a stream.
+	//
+	// Deprecated: stream operations now return ErrStreamClosed or
+	// ErrSessionClosed instead.
 	ErrBrokenPipe = errors.New("broken pipe")
 
-	// ErrWriteTimeout if the write operation on a stream times out
-	ErrWriteTimeout = errors.New("wsmux: write operation timed out")
+	// ErrStreamClosed is returned by stream operations after the stream has
+	// been closed locally, or reset by either end.  The session is unaffected,
+	// so a new stream can be opened.
+	ErrStreamClosed = errors.New("stream closed")
+
+	// ErrWriteTimeout if the write operation on a stream times out.  This
+	// implements net.Error, and its Timeout method returns true.
+	ErrWriteTimeout error = netError{errString: "wsmux: write operation timed out", timeout: true, temporary: true}
 
-	// ErrReadTimeout if the read operation on a stream times out
-	ErrReadTimeout = errors.New("wsmux: read operation timed out")
+	// ErrReadTimeout if the read operation on a stream times out.  This
+	// implements net.Error, and its Timeout method returns true.
+	ErrReadTimeout error = netError{errString: "wsmux: read operation timed out", timeout: true, temporary: true}
 
 	// ErrNoCapacity is returns if the read buffer is full and a session attempts to load
 	// more data into the buffer
@@ -25,7 +89,9 @@ var (
 	// ErrDuplicateStream is returned when a duplicate stream is found
 	ErrDuplicateStream = errors.New("duplicate stream")
 
-	//ErrSessionClosed is returned when a closed session tries to create a new stream
+	//ErrSessionClosed is returned when a closed session tries to create a new stream.
+	// It is also returned by operations on streams of a session which has
+	// closed; recovering requires a new session.
 	ErrSessionClosed = errors.New("session closed")
 
 	//ErrInvalidDeadline is returned when the time is before the current time
@@ -37,6 +103,71 @@ var (
 	// ErrMalformedHeader indicate a websocket frame header was invalid.
 	ErrMalformedHeader = errors.New("malformed header")
 
+	// ErrMalformedFrame indicates a websocket frame payload was invalid for its
+	// message type.
+	ErrMalformedFrame = errors.New("malformed frame")
+
+	// ErrUnexpectedMessage indicates a websocket message of a type other than
+	// that configured for the session
+	ErrUnexpectedMessage = errors.New("unexpected websocket message type")
+
+	// ErrFrameTooLarge indicates a frame larger than Config.MaxFrameSize
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
 	// ErrTooManySyns indicates too many un-accepted new incoming streams
 	ErrTooManySyns = errors.New("too many un-accepted new incoming streams")
+
+	// ErrTooManyStreams is returned from Open when the session already has
+	// Config.MaxStreams streams
+	ErrTooManyStreams = errors.New("too many streams")
+
+	// ErrBufferLimit is returned from Open, and from a stream's
+	// SetReceiveWindow, when the stream's receive window would exceed the
+	// session's Config.MaxTotalBuffer
+	ErrBufferLimit = errors.New("session buffer limit reached")
+
+	// ErrStreamIDExhausted is returned from Open when every stream ID
+	// available to the local end is in use
+	ErrStreamIDExhausted = errors.New("stream IDs exhausted")
+
+	// ErrStreamRefused is returned from Open when the remote end refuses the
+	// new stream
+	ErrStreamRefused = errors.New("stream refused by remote")
+
+	// ErrWindowExceeded indicates that the remote end sent more data than the
+	// receive window allowed
+	ErrWindowExceeded = errors.New("remote exceeded receive window")
+
+	// ErrUnexpectedFrame indicates a frame which is not valid in the state
+	// of its stream, such as a msgSYNACK for a stream which was already
+	// accepted
+	ErrUnexpectedFrame = errors.New("unexpected frame for stream state")
+
+	// ErrInvalidStreamID indicates the remote end tried to open a stream with
+	// an ID reserved for streams opened by the local end
+	ErrInvalidStreamID = errors.New("stream ID has wrong parity for remote end")
+
+	// ErrDraining is returned from Accept and Open once the session has
+	// started draining; see Session.StartDraining
+	ErrDraining = errors.New("session is draining")
+
+	// ErrMetadataTooLarge is returned from OpenWithMeta when the metadata is
+	// larger than MaxMetadataSize
+	ErrMetadataTooLarge = errors.New("stream metadata too large")
+
+	// ErrUnsupportedSubprotocol is returned from Upgrade when the client
+	// offers none of the websocket subprotocols in Config.Subprotocols
+	ErrUnsupportedSubprotocol = errors.New("unsupported websocket subprotocol")
+
+	// ErrUnsupportedVersion indicates that the remote end supports no
+	// protocol version in common with the local end; see
+	// Config.NegotiateVersion
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrPoolClosed is returned from Pool.Open after the pool has been closed
+	ErrPoolClosed = errors.New("pool closed")
+
+	// errStreamRejected is returned internally when Config.OnAccept rejects
+	// a stream, which Accept then skips
+	errStreamRejected = errors.New("stream rejected")
 )
@@ -0,0 +1,43 @@
+package wsmux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestTimeoutErrors(t *testing.T) {
+	for _, err := range []error{ErrAcceptTimeout, ErrReadTimeout, ErrWriteTimeout} {
+		ne, ok := err.(net.Error)
+		if !ok {
+			t.Fatalf("%v does not implement net.Error", err)
+		}
+		if !ne.Timeout() || !ne.Temporary() {
+			t.Fatalf("%v should be a temporary timeout", err)
+		}
+		if !errors.Is(fmt.Errorf("wrapped: %w", err), err) {
+			t.Fatalf("errors.Is does not match wrapped %v", err)
+		}
+	}
+	if errors.Is(ErrReadTimeout, ErrWriteTimeout) {
+		t.Fatal("distinct timeout errors should not match")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &ProtocolError{Kind: ErrWindowExceeded, StreamID: 3, HasStreamID: true})
+	if !errors.Is(err, ErrWindowExceeded) {
+		t.Fatal("errors.Is should match the kind")
+	}
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.StreamID != 3 {
+		t.Fatalf("errors.As should find the ProtocolError, got %v", pe)
+	}
+	if got, want := pe.Error(), "protocol error on stream 3: remote exceeded receive window"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := (&ProtocolError{Kind: ErrMalformedFrame}).Error(), "protocol error: malformed frame"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package wsmux_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/wsmux"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/wsmux/wsmuxtest"
+)
+
+// A Session is a net.Listener, so an http.Server can serve HTTP over it, with
+// each stream carrying one HTTP connection.  The other end makes requests with
+// an http.Transport which opens a new stream for each connection.
+func ExampleSession_httpServer() {
+	client, server := wsmuxtest.NewSessionPair(wsmux.Config{})
+	defer client.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello, %s", r.URL.Query().Get("name"))
+	})
+	httpServer := &http.Server{Handler: mux}
+	go func() { _ = httpServer.Serve(server) }()
+	defer httpServer.Close()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			// the address is ignored; every connection is a new stream
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return client.OpenContext(ctx)
+			},
+		},
+	}
+	for _, name := range []string{"alice", "bob"} {
+		resp, err := httpClient.Get("http://wsmux/hello?name=" + name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		fmt.Println(resp.StatusCode, string(body))
+	}
+
+	// Output:
+	// 200 hello, alice
+	// 200 hello, bob
+}
@@ -15,9 +15,26 @@ const (
 	msgACK byte = 2
 	// Used to close a stream
 	msgFIN byte = 3
+	// Used to abruptly terminate a stream
+	msgRST byte = 4
+
+	// Accepts a stream; only in protocol version 2 and later.  Types 5 and 6
+	// are not frames (see below).
+	msgSYNACK byte = 7
 
 	// last message type
-	msgMax byte = msgFIN
+	msgMax byte = msgSYNACK
+
+	// Not a frame: a websocket message beginning with a header of this type
+	// (with stream ID 0) contains several frames, each preceded by its
+	// little-endian u32 length.  See Config.BatchWrites.
+	msgBAT byte = 5
+
+	// Not a frame: a websocket message beginning with a header of this type
+	// (with stream ID 0), sent as the first message by a session with
+	// Config.NegotiateVersion, advertises the newest protocol version the
+	// sender supports as a little-endian u32.  See ProtocolVersion.
+	msgVER byte = 6
 )
 
 // header contains a frame header.  It contains an 8-bit message type (`msg`,
@@ -53,10 +70,20 @@ func newHeader(msg byte, id uint32) header {
 // type:
 //
 // * msgDAT: the payload is the binary data
-// * msgSYN: no payload
-// * msgACK: payload is a little-endian u32 indicating the number of bytes handled
-//   on the remote end and thus no longer "in flight".
+// * msgSYN: optionally, a little-endian u32 giving the opener's initial receive
+//   window.  If absent, the accepting end uses its configured initial send window.
+//   The window may be followed by up to MaxMetadataSize bytes of metadata
+//   supplied by the opener; see Session.OpenWithMeta.
+// * msgACK: payload is a little-endian u32 giving additional credit: the number
+//   of bytes handled on the remote end and thus no longer "in flight", plus any
+//   increase in the remote end's receive window.  In protocol version 1, the
+//   first msgACK for a stream accepts it, and gives the accepting end's initial
+//   receive window.
 // * msgFIN: no payload
+// * msgRST: no payload
+// * msgSYNACK: in protocol version 2 and later, accepts a stream in place of
+//   its first msgACK, with the same payload, so that a msgACK only ever adds
+//   credit
 type frame struct {
 	id      uint32
 	msg     byte
@@ -71,25 +98,101 @@ func (f frame) serialize() []byte {
 }
 
 // deserializeFrame creates a frame from a byte array. The byte array is
-// assumed to contain exactly one frame.
-func deserializeFrame(data []byte) (*frame, error) {
+// assumed to contain exactly one frame, as delimited by the websocket
+// message.  Frames with an invalid header or payload result in an error.  The
+// frame is returned by value, and its payload aliases data, so that parsing
+// does not allocate.
+func deserializeFrame(data []byte) (frame, error) {
 	if len(data) < HEADER_SIZE {
-		return nil, ErrMalformedHeader
+		return frame{}, ErrMalformedHeader
 	}
 
 	hdr := header(data[:HEADER_SIZE])
 	msg := hdr.msg()
-	if msg > msgMax {
-		return nil, ErrMalformedHeader
+	if !isFrameType(msg) {
+		return frame{}, ErrMalformedHeader
+	}
+
+	payload := data[HEADER_SIZE:]
+	if err := validatePayload(msg, payload); err != nil {
+		return frame{}, err
 	}
 
-	return &frame{
+	return frame{
 		id:      hdr.id(),
 		msg:     msg,
-		payload: data[HEADER_SIZE:],
+		payload: payload,
 	}, nil
 }
 
+// isFrameType returns true if msg is the message type of a frame, as opposed
+// to an unknown type or one of the message types which are not frames
+func isFrameType(msg byte) bool {
+	return msg <= msgMax && msg != msgBAT && msg != msgVER
+}
+
+// validatePayload checks that a payload is valid for the message type.
+func validatePayload(msg byte, payload []byte) error {
+	// the capacity in a msgACK frame must be complete, or it would be
+	// misinterpreted (or cause a panic) when parsed
+	if (msg == msgACK || msg == msgSYNACK) && len(payload) != 4 {
+		return ErrMalformedFrame
+	}
+	if msg == msgSYN && len(payload) != 0 && len(payload) < 4 {
+		return ErrMalformedFrame
+	}
+	return nil
+}
+
+// Frame is a single frame of the wsmux wire format, as carried in one
+// websocket message.  EncodeFrame and DecodeFrame convert frames to and from
+// that format, so that other implementations of the protocol, and fuzz tests,
+// can exercise it directly.
+//
+// The payload depends on the frame type:
+//
+//	FrameDAT: the stream data
+//	FrameSYN: empty, or a little-endian u32 giving the opener's initial
+//	          receive window, followed by up to MaxMetadataSize bytes of
+//	          stream metadata
+//	FrameACK: a little-endian u32 giving additional send credit
+//	FrameFIN: empty
+//	FrameRST: empty
+//	FrameSYNACK: a little-endian u32 giving the accepting end's initial
+//	          receive window (protocol version 2 and later)
+type Frame struct {
+	Type     FrameType
+	StreamID uint32
+	Payload  []byte
+}
+
+// EncodeFrame returns the wire format of a frame: a header containing the
+// frame type and the little-endian u32 stream ID, followed by the payload.  It
+// fails with ErrMalformedHeader for an unknown frame type, or with
+// ErrMalformedFrame if the payload is invalid for the frame type.
+func EncodeFrame(f Frame) ([]byte, error) {
+	msg := byte(f.Type)
+	if !isFrameType(msg) {
+		return nil, ErrMalformedHeader
+	}
+	if err := validatePayload(msg, f.Payload); err != nil {
+		return nil, err
+	}
+	return frame{id: f.StreamID, msg: msg, payload: f.Payload}.serialize(), nil
+}
+
+// DecodeFrame parses the wire format of a frame, as produced by EncodeFrame.
+// The data must contain exactly one frame, as delimited by a websocket
+// message.  It fails with ErrMalformedHeader or ErrMalformedFrame if the data
+// is not a valid frame.  The returned frame's Payload aliases data.
+func DecodeFrame(data []byte) (Frame, error) {
+	fr, err := deserializeFrame(data)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: FrameType(fr.msg), StreamID: fr.id, Payload: fr.payload}, nil
+}
+
 // String returns a human-readable version of the frame.
 //
 // Note that if a msgDAT frame contains binary data, that will not be encoded
@@ -107,6 +210,11 @@ func (f frame) String() string {
 		str += strconv.Itoa(int(binary.LittleEndian.Uint32(f.payload)))
 	case msgFIN:
 		str += "FIN"
+	case msgRST:
+		str += "RST"
+	case msgSYNACK:
+		str += "SYNACK "
+		str += strconv.Itoa(int(binary.LittleEndian.Uint32(f.payload)))
 	}
 	return str
 }
@@ -119,9 +227,13 @@ func newDataFrame(id uint32, buf []byte) frame {
 	return frame
 }
 
-// newSynFrame creates a new msgSYN frame.
-func newSynFrame(id uint32) frame {
-	frame := frame{id: id, msg: msgSYN, payload: nil}
+// newSynFrame creates a new msgSYN frame advertising the given receive window,
+// followed by the stream metadata, if any.
+func newSynFrame(id uint32, window uint32, meta []byte) frame {
+	frame := frame{id: id, msg: msgSYN}
+	frame.payload = make([]byte, 4, 4+len(meta))
+	binary.LittleEndian.PutUint32(frame.payload, window)
+	frame.payload = append(frame.payload, meta...)
 	return frame
 }
 
@@ -133,7 +245,20 @@ func newAckFrame(id uint32, cap uint32) frame {
 	return frame
 }
 
+// newSynAckFrame creates a new msgSYNACK frame giving the initial receive
+// window.
+func newSynAckFrame(id uint32, window uint32) frame {
+	frame := newAckFrame(id, window)
+	frame.msg = msgSYNACK
+	return frame
+}
+
 // newSynFrame creates a new msgFIN frame.
 func newFinFrame(id uint32) frame {
 	return frame{id: id, msg: msgFIN, payload: nil}
 }
+
+// newRstFrame creates a new msgRST frame.
+func newRstFrame(id uint32) frame {
+	return frame{id: id, msg: msgRST, payload: nil}
+}
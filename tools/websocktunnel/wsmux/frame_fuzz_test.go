@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package wsmux_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/wsmux"
+)
+
+func FuzzDecodeFrame(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 0, 0, 'h', 'i'})
+	f.Add([]byte{1, 2, 0, 0, 0, 0, 4, 0, 0})
+	f.Add([]byte{2, 3, 0, 0, 0, 0, 4, 0, 0})
+	f.Add([]byte{4, 5, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr, err := wsmux.DecodeFrame(data)
+		if err != nil {
+			return
+		}
+		// any frame which decodes must encode back to the same bytes
+		encoded, err := wsmux.EncodeFrame(fr)
+		if err != nil {
+			t.Fatalf("decoded frame %+v does not encode: %v", fr, err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("frame %v re-encoded as %v", data, encoded)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package wsmux
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthThresholds are the limits beyond which HealthHandler reports a
+// session as unhealthy.  Zero fields disable the corresponding check.
+type HealthThresholds struct {
+	// MaxStreams is the largest number of streams a healthy session tracks.
+	MaxStreams int
+
+	// MaxRTT is the largest round-trip time, as reported by `session.RTT()`,
+	// of a healthy session.  Sessions which have not yet measured the RTT
+	// pass this check.
+	MaxRTT time.Duration
+
+	// MaxIdle is the longest time a healthy session goes without receiving a
+	// frame from the remote end.  Keepalives are not frames, so this should
+	// only be set where the remote end is expected to send data regularly.
+	MaxIdle time.Duration
+}
+
+// Health is the JSON body written by HealthHandler.
+type Health struct {
+	// Healthy is true if the session is open and within the thresholds.
+	Healthy bool `json:"healthy"`
+
+	// Problems describes each reason the session is unhealthy.
+	Problems []string `json:"problems,omitempty"`
+
+	// RTT is the session's smoothed round-trip time, in nanoseconds.
+	RTT time.Duration `json:"rtt"`
+
+	// Idle is the time since a frame was last received, in nanoseconds.
+	Idle time.Duration `json:"idle"`
+
+	// Stats are the session's counters.
+	Stats Stats `json:"stats"`
+}
+
+// HealthHandler returns an HTTP handler reporting the health of the session,
+// for use with existing health-check infrastructure.  It responds with 200 OK
+// if the session is open and within the given thresholds, and 503 Service
+// Unavailable otherwise, in either case with a JSON-encoded Health body.
+func HealthHandler(s *Session, thresholds HealthThresholds) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := s.health(thresholds)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if h.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(h)
+	}
+}
+
+// health checks the session against the given thresholds
+func (s *Session) health(thresholds HealthThresholds) Health {
+	h := Health{
+		RTT:   s.RTT(),
+		Idle:  s.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&s.lastReceived))),
+		Stats: s.Stats(),
+	}
+	if s.IsClosed() {
+		h.Problems = append(h.Problems, "session closed")
+	}
+	if thresholds.MaxStreams > 0 && h.Stats.ActiveStreams > thresholds.MaxStreams {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d streams exceeds %d", h.Stats.ActiveStreams, thresholds.MaxStreams))
+	}
+	if thresholds.MaxRTT > 0 && h.RTT > thresholds.MaxRTT {
+		h.Problems = append(h.Problems, fmt.Sprintf("RTT %v exceeds %v", h.RTT, thresholds.MaxRTT))
+	}
+	if thresholds.MaxIdle > 0 && h.Idle > thresholds.MaxIdle {
+		h.Problems = append(h.Problems, fmt.Sprintf("idle for %v, exceeding %v", h.Idle, thresholds.MaxIdle))
+	}
+	h.Healthy = len(h.Problems) == 0
+	return h
+}
@@ -0,0 +1,82 @@
+package wsmux
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+// checkHealth calls the handler, checking the status code and returning the
+// decoded body
+func checkHealth(t *testing.T, handler http.HandlerFunc, status int) Health {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON, got %q", ct)
+	}
+	var h Health
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	session := Client(conn, Config{Log: genLogger(), clock: clock})
+	defer session.Close()
+
+	handler := HealthHandler(session, HealthThresholds{MaxStreams: 1, MaxRTT: time.Second, MaxIdle: time.Minute})
+	h := checkHealth(t, handler, http.StatusOK)
+	if !h.Healthy || len(h.Problems) != 0 {
+		t.Fatalf("expected a healthy session, got %+v", h)
+	}
+
+	// exceed each threshold in turn
+	atomic.StoreInt64(&session.rtt, int64(2*time.Second))
+	h = checkHealth(t, handler, http.StatusServiceUnavailable)
+	if h.Healthy || len(h.Problems) != 1 || h.RTT != 2*time.Second {
+		t.Fatalf("expected the RTT to be a problem, got %+v", h)
+	}
+	atomic.StoreInt64(&session.rtt, 0)
+
+	clock.Advance(2 * time.Minute)
+	h = checkHealth(t, handler, http.StatusServiceUnavailable)
+	if len(h.Problems) != 1 || h.Idle != 2*time.Minute {
+		t.Fatalf("expected idleness to be a problem, got %+v", h)
+	}
+
+	session.mu.Lock()
+	session.streams[1] = newStream(1, session)
+	session.streams[3] = newStream(3, session)
+	session.mu.Unlock()
+	h = checkHealth(t, HealthHandler(session, HealthThresholds{MaxStreams: 1}), http.StatusServiceUnavailable)
+	if len(h.Problems) != 1 || h.Stats.ActiveStreams != 2 {
+		t.Fatalf("expected the stream count to be a problem, got %+v", h)
+	}
+
+	// without thresholds, only a closed session is unhealthy
+	handler = HealthHandler(session, HealthThresholds{})
+	checkHealth(t, handler, http.StatusOK)
+	_ = session.Close()
+	h = checkHealth(t, handler, http.StatusServiceUnavailable)
+	if len(h.Problems) != 1 || h.Problems[0] != "session closed" {
+		t.Fatalf("expected a closed session, got %+v", h)
+	}
+}
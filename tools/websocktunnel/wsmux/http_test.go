@@ -3,12 +3,16 @@ package wsmux
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
@@ -177,3 +181,79 @@ func TestWebSocket(t *testing.T) {
 		t.Fatal("message inconsistent")
 	}
 }
+
+// TestHTTPServer runs an http.Server over a session, with the server's
+// timeouts and keep-alives, and an http.Transport opening a stream for each
+// connection.
+func TestHTTPServer(t *testing.T) {
+	sessions := make(chan *Session, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		sessions <- session
+		<-session.Done()
+	}))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		// the body must be read before writing the response
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(body)
+	})
+	httpServer := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  time.Second,
+	}
+	served := make(chan error, 1)
+	go func() { served <- httpServer.Serve(<-sessions) }()
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return session.OpenContext(ctx)
+		},
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// several requests on each connection, with bodies larger
+			// than the stream window
+			body := strings.Repeat(strconv.Itoa(i), 10000)
+			for j := 0; j < 3; j++ {
+				resp, err := httpClient.Post("http://wsmux/echo", "text/plain", strings.NewReader(body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := ioutil.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if err != nil || string(got) != body {
+					t.Errorf("unexpected response of %d bytes, %v", len(got), err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("expected http.ErrServerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package wsmux
+
+import (
+	"strconv"
+)
+
+// Direction indicates whether a frame is being sent or was received.
+type Direction int
+
+const (
+	// Inbound frames were received from the remote end
+	Inbound Direction = iota
+	// Outbound frames are about to be sent to the remote end
+	Outbound
+)
+
+// String returns "inbound" or "outbound"
+func (d Direction) String() string {
+	if d == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// FrameType is the message type of a frame.
+type FrameType byte
+
+const (
+	// FrameDAT carries stream data
+	FrameDAT = FrameType(msgDAT)
+	// FrameSYN opens a stream
+	FrameSYN = FrameType(msgSYN)
+	// FrameACK acknowledges data, or accepts a stream in protocol version 1
+	FrameACK = FrameType(msgACK)
+	// FrameFIN closes one side of a stream
+	FrameFIN = FrameType(msgFIN)
+	// FrameRST abruptly terminates a stream
+	FrameRST = FrameType(msgRST)
+	// FrameSYNACK accepts a stream in protocol version 2 and later
+	FrameSYNACK = FrameType(msgSYNACK)
+)
+
+// String returns the name of the frame type, such as "DAT"
+func (t FrameType) String() string {
+	switch t {
+	case FrameDAT:
+		return "DAT"
+	case FrameSYN:
+		return "SYN"
+	case FrameACK:
+		return "ACK"
+	case FrameFIN:
+		return "FIN"
+	case FrameRST:
+		return "RST"
+	case FrameSYNACK:
+		return "SYNACK"
+	}
+	return "FrameType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// FrameInfo describes a frame passed to Config.FrameInterceptor.
+type FrameInfo struct {
+	// StreamID is the ID of the stream the frame belongs to
+	StreamID uint32
+	// Type is the frame's message type
+	Type FrameType
+	// Length is the length of the frame's payload, in bytes
+	Length int
+}
+
+// intercept calls the frame interceptor, if there is one
+func (s *Session) intercept(dir Direction, f frame) error {
+	if s.frameInterceptor == nil {
+		return nil
+	}
+	return s.frameInterceptor(dir, FrameInfo{StreamID: f.id, Type: FrameType(f.msg), Length: len(f.payload)})
+}
@@ -0,0 +1,145 @@
+package wsmux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+type recordingInterceptor struct {
+	mu     sync.Mutex
+	frames map[Direction][]FrameInfo
+	reject func(Direction, FrameInfo) error
+}
+
+func (r *recordingInterceptor) intercept(dir Direction, f FrameInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frames == nil {
+		r.frames = make(map[Direction][]FrameInfo)
+	}
+	r.frames[dir] = append(r.frames[dir], f)
+	if r.reject != nil {
+		return r.reject(dir, f)
+	}
+	return nil
+}
+
+func (r *recordingInterceptor) seen(dir Direction, typ FrameType) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.frames[dir] {
+		if f.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFrameInterceptor(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	rec := &recordingInterceptor{}
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), FrameInterceptor: rec.intercept})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != "Hello" {
+		t.Fatalf("bad message %q", final.String())
+	}
+
+	for _, typ := range []FrameType{FrameSYN, FrameDAT, FrameFIN} {
+		if !rec.seen(Outbound, typ) {
+			t.Errorf("outbound %v frame not intercepted", typ)
+		}
+	}
+	for _, typ := range []FrameType{FrameACK, FrameDAT} {
+		if !rec.seen(Inbound, typ) {
+			t.Errorf("inbound %v frame not intercepted", typ)
+		}
+	}
+	rec.mu.Lock()
+	for _, f := range rec.frames[Outbound] {
+		if f.Type == FrameDAT && (f.StreamID != 1 || f.Length != 5) {
+			t.Errorf("unexpected outbound DAT frame %+v", f)
+		}
+	}
+	rec.mu.Unlock()
+}
+
+func TestFrameInterceptorReject(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	errRejected := errors.New("rejected")
+	rec := &recordingInterceptor{reject: func(dir Direction, f FrameInfo) error {
+		if f.Type != FrameDAT {
+			return nil
+		}
+		// drop echoed data, and fail writes of "bad"
+		if dir == Inbound || f.Length == 3 {
+			return errRejected
+		}
+		return nil
+	}}
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), FrameInterceptor: rec.intercept})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("bad")); err != errRejected {
+		t.Fatalf("expected interceptor error from Write, got %v", err)
+	}
+
+	str, err = session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if final.Len() != 0 {
+		t.Fatalf("inbound data should have been dropped, got %q", final.String())
+	}
+	if !rec.seen(Inbound, FrameDAT) {
+		t.Fatal("echoed data was not received")
+	}
+	if session.IsClosed() {
+		t.Fatal("session should remain open")
+	}
+}
@@ -0,0 +1,173 @@
+package wsmux
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+// LogLevel controls the verbosity of a session's logging.
+type LogLevel int
+
+const (
+	// LogLevelError logs only errors, such as protocol violations and
+	// failures writing to the websocket.
+	LogLevelError LogLevel = iota + 1
+	// LogLevelInfo additionally logs session-level events, such as the
+	// session closing or streams being refused.  This is the default.
+	LogLevelInfo
+	// LogLevelDebug additionally logs per-stream and per-frame activity.
+	// This is very verbose and not intended for production use.
+	LogLevelDebug
+)
+
+// String returns "ERROR", "INFO" or "DEBUG"
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelError:
+		return "ERROR"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelDebug:
+		return "DEBUG"
+	}
+	return "LogLevel(" + strconv.Itoa(int(l)) + ")"
+}
+
+// LogRecord is a single message, as passed to a StructuredLogger.
+type LogRecord struct {
+	// Level is the level at which the message was logged
+	Level LogLevel
+	// Message is the formatted message, without any stream ID
+	Message string
+
+	// StreamID is the ID of the stream the message concerns; it is only
+	// meaningful if HasStreamID is true
+	StreamID    uint32
+	HasStreamID bool
+}
+
+// StructuredLogger may be implemented by the Config.Log logger to receive each
+// message with its level and stream ID as a LogRecord, rather than as a
+// single string passed to Printf.  Messages are still only logged up to
+// Config.LogLevel.
+type StructuredLogger interface {
+	util.Logger
+	Log(r LogRecord)
+}
+
+// StdLogger is a StructuredLogger which writes to a standard library
+// *log.Logger, prefixing each message with its level and any stream ID.  If
+// Logger is nil, it writes to the standard logger.
+type StdLogger struct {
+	Logger *log.Logger
+}
+
+func (l StdLogger) output(s string) {
+	if l.Logger == nil {
+		log.Print(s)
+		return
+	}
+	l.Logger.Print(s)
+}
+
+// Printf logs a message without a level
+func (l StdLogger) Printf(format string, a ...interface{}) {
+	l.output(fmt.Sprintf(format, a...))
+}
+
+// Print logs a message without a level
+func (l StdLogger) Print(a ...interface{}) {
+	l.output(fmt.Sprint(a...))
+}
+
+// Log logs a message as "[LEVEL] stream ID: message"
+func (l StdLogger) Log(r LogRecord) {
+	if r.HasStreamID {
+		l.output(fmt.Sprintf("[%v] stream %d: %s", r.Level, r.StreamID, r.Message))
+		return
+	}
+	l.output(fmt.Sprintf("[%v] %s", r.Level, r.Message))
+}
+
+// leveledLogger wraps a util.Logger, discarding messages above the configured
+// level.
+type leveledLogger struct {
+	logger util.Logger
+	level  LogLevel
+}
+
+func newLeveledLogger(logger util.Logger, level LogLevel) *leveledLogger {
+	if logger == nil {
+		logger = &util.NilLogger{}
+	}
+	if level == 0 {
+		level = LogLevelInfo
+	}
+	return &leveledLogger{logger: logger, level: level}
+}
+
+// enabled returns true if messages at the given level are logged
+func (l *leveledLogger) enabled(level LogLevel) bool {
+	return level <= l.level
+}
+
+// log writes a message, passing a StructuredLogger the stream ID separately,
+// and otherwise prefixing the message with it
+func (l *leveledLogger) log(r LogRecord, format string, a ...interface{}) {
+	if !l.enabled(r.Level) {
+		return
+	}
+	if sl, ok := l.logger.(StructuredLogger); ok {
+		r.Message = fmt.Sprintf(format, a...)
+		sl.Log(r)
+		return
+	}
+	if r.HasStreamID {
+		format = "stream " + strconv.FormatUint(uint64(r.StreamID), 10) + ": " + format
+	}
+	l.logger.Printf(format, a...)
+}
+
+// Errorf logs at LogLevelError
+func (l *leveledLogger) Errorf(format string, a ...interface{}) {
+	l.log(LogRecord{Level: LogLevelError}, format, a...)
+}
+
+// Infof logs at LogLevelInfo
+func (l *leveledLogger) Infof(format string, a ...interface{}) {
+	l.log(LogRecord{Level: LogLevelInfo}, format, a...)
+}
+
+// Debugf logs at LogLevelDebug
+func (l *leveledLogger) Debugf(format string, a ...interface{}) {
+	l.log(LogRecord{Level: LogLevelDebug}, format, a...)
+}
+
+// forStream returns a logger for messages concerning the given stream
+func (l *leveledLogger) forStream(id uint32) streamLogger {
+	return streamLogger{l: l, id: id}
+}
+
+// streamLogger logs messages concerning a single stream, with its ID
+type streamLogger struct {
+	l  *leveledLogger
+	id uint32
+}
+
+// Errorf logs at LogLevelError
+func (l streamLogger) Errorf(format string, a ...interface{}) {
+	l.l.log(LogRecord{Level: LogLevelError, StreamID: l.id, HasStreamID: true}, format, a...)
+}
+
+// Infof logs at LogLevelInfo
+func (l streamLogger) Infof(format string, a ...interface{}) {
+	l.l.log(LogRecord{Level: LogLevelInfo, StreamID: l.id, HasStreamID: true}, format, a...)
+}
+
+// Debugf logs at LogLevelDebug
+func (l streamLogger) Debugf(format string, a ...interface{}) {
+	l.l.log(LogRecord{Level: LogLevelDebug, StreamID: l.id, HasStreamID: true}, format, a...)
+}
@@ -0,0 +1,90 @@
+package wsmux
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+)
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) Printf(format string, a ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, a...))
+}
+
+func (r *recordingLogger) Print(a ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprint(a...))
+}
+
+func TestLogLevels(t *testing.T) {
+	cases := []struct {
+		level    LogLevel
+		expected []string
+	}{
+		{0, []string{"error", "info"}},
+		{LogLevelError, []string{"error"}},
+		{LogLevelInfo, []string{"error", "info"}},
+		{LogLevelDebug, []string{"error", "info", "debug"}},
+	}
+	for _, c := range cases {
+		rec := &recordingLogger{}
+		l := newLeveledLogger(rec, c.level)
+		l.Errorf("error")
+		l.Infof("info")
+		l.Debugf("debug")
+		if fmt.Sprint(rec.lines) != fmt.Sprint(c.expected) {
+			t.Errorf("level %d: expected %v, got %v", c.level, c.expected, rec.lines)
+		}
+	}
+
+	// a nil logger discards everything
+	newLeveledLogger(nil, LogLevelDebug).Errorf("discarded")
+}
+
+type structuredRecorder struct {
+	recordingLogger
+	records []LogRecord
+}
+
+func (r *structuredRecorder) Log(rec LogRecord) {
+	r.records = append(r.records, rec)
+}
+
+func TestStreamLogging(t *testing.T) {
+	// a plain logger gets the stream ID as a prefix
+	rec := &recordingLogger{}
+	l := newLeveledLogger(rec, LogLevelInfo)
+	l.forStream(3).Infof("refusing stream: %v", ErrTooManyStreams)
+	l.forStream(3).Debugf("discarded")
+	if fmt.Sprint(rec.lines) != "[stream 3: refusing stream: too many streams]" {
+		t.Fatalf("unexpected lines %q", rec.lines)
+	}
+
+	// a structured logger gets the level and stream ID separately
+	srec := &structuredRecorder{}
+	l = newLeveledLogger(srec, LogLevelInfo)
+	l.forStream(3).Errorf("bad %s", "frame")
+	l.Infof("closed")
+	l.Debugf("discarded")
+	expected := []LogRecord{
+		{Level: LogLevelError, Message: "bad frame", StreamID: 3, HasStreamID: true},
+		{Level: LogLevelInfo, Message: "closed"},
+	}
+	if fmt.Sprint(srec.records) != fmt.Sprint(expected) || len(srec.lines) != 0 {
+		t.Fatalf("unexpected records %v, lines %q", srec.records, srec.lines)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLeveledLogger(StdLogger{Logger: log.New(&buf, "", 0)}, LogLevelInfo)
+	l.forStream(3).Errorf("could not reset stream: %v", ErrSessionClosed)
+	l.Infof("session closed")
+	expected := "[ERROR] stream 3: could not reset stream: session closed\n[INFO] session closed\n"
+	if buf.String() != expected {
+		t.Fatalf("got %q, want %q", buf.String(), expected)
+	}
+}
@@ -7,6 +7,9 @@
 package wsmux
 
 import (
+	"context"
+	"crypto/tls"
+	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,38 +17,426 @@ import (
 )
 
 // Config contains configuration for a new session, as created with `Server` or `Client`.
-// All of the fields are optional.
+// All of the fields are optional.  Sessions can also be configured with
+// functional options; see Option.
 type Config struct {
 	// KeepAliveInterval is the interval between keepAlives.  The session will send websocket
-	// ping frames at this interval. Default: 10 seconds
+	// ping frames at this interval, and abort the session if no pong frame is received
+	// for two intervals.  Negative values disable keepalives, so that only
+	// ReadTimeout, if set, detects a failed connection. Default: 20 seconds
 	KeepAliveInterval time.Duration
 
+	// KeepAliveJitter varies each interval between keepalives randomly, by up
+	// to this fraction of KeepAliveInterval in either direction, so that
+	// sessions created together, for example when many clients reconnect at
+	// once, do not ping in lockstep.  Values above 0.5 are reduced to 0.5, and
+	// negative values disable jitter.  Default: 0.1 (up to 10%)
+	KeepAliveJitter float64
+
 	// StreamAcceptDeadline is the time after which opening a new stream will time out.
+	// Negative values disable the deadline, so that Open waits until the
+	// remote end accepts or refuses the stream, or the session closes.
 	// Default: 30 seconds
 	StreamAcceptDeadline time.Duration
 
+	// SynRetransmits is the number of times Open resends the msgSYN frame
+	// for a new stream if the remote end has not accepted it, waiting
+	// SynRetransmitInterval after each attempt, before failing when
+	// StreamAcceptDeadline expires.  This only helps where frames may be
+	// dropped above the websocket, for example by a FrameInterceptor.  The
+	// remote end ignores a repeated msgSYN frame with the same stream ID,
+	// window and metadata as an existing stream, rather than treating it as a
+	// protocol violation.  Default: 0 (no retransmission)
+	SynRetransmits int
+
+	// SynRetransmitInterval is the time to wait before resending a msgSYN
+	// frame; see SynRetransmits.  Default: StreamAcceptDeadline, or 30
+	// seconds if it is disabled, divided by SynRetransmits + 1
+	SynRetransmitInterval time.Duration
+
 	// CloseCallback is a callback function which is invoked when the session is closed.
 	// This can be updated later with `session.SetCloseCallback(..)`.
 	CloseCallback func()
 
-	// Log must implement util.Logger. This defaults to NilLogger.
+	// RemoteCloseCallback is a callback function which is invoked, after
+	// CloseCallback, when the session is closed because the remote end closed
+	// the websocket connection.  It is not invoked when the session is closed
+	// locally.
+	RemoteCloseCallback func()
+
+	// OnStreamOpen, if set, is called with the stream ID whenever a new stream
+	// is added to the session, either by Open or by the remote end.
+	OnStreamOpen func(id uint32)
+
+	// OnStreamClose, if set, is called with the stream ID whenever a stream
+	// is removed from the session.  This includes streams for which Open
+	// failed, so every call to OnStreamOpen is matched by a call to
+	// OnStreamClose.
+	OnStreamClose func(id uint32)
+
+	// OnAccept, if set, is called with the stream ID when Accept (or
+	// AcceptContext or AcceptN) takes a stream opened by the remote end,
+	// before the stream is accepted.  It returns the receive window to
+	// advertise to the remote end for that stream, in place of
+	// StreamBufferSize, and whether to accept the stream at all.  A window of
+	// zero selects StreamBufferSize.  A stream which is not accepted is reset,
+	// and Accept waits for the next stream instead.  A stream whose window
+	// would exceed MaxTotalBuffer is likewise reset.
+	OnAccept func(id uint32) (window uint32, accept bool)
+
+	// Log must implement util.Logger. This defaults to NilLogger.  Use
+	// StdLogger to write to the standard library log package, or SlogLogger
+	// for log/slog; these implement StructuredLogger, receiving the level and
+	// stream ID of each message.
 	Log util.Logger
 
+	// LogLevel controls which messages are written to Log.  Per-stream and
+	// per-frame activity is only logged at LogLevelDebug.
+	// Default: LogLevelInfo
+	LogLevel LogLevel
+
 	// StreamBufferSize sets the maximum buffer size of streams created by the session.
-	// Default: 1024 bytes
+	// This is the receive window advertised to the remote end when accepting a
+	// stream, and thus the amount of data the remote end may send before it
+	// must wait for the local application to read.  Values less than or equal
+	// to zero select the default.
+	// Default: 1024 bytes (DefaultCapacity)
 	StreamBufferSize int
+
+	// ReuseBuffers keeps the receive buffers of streams removed from the
+	// session in a pool, for reuse by new streams, rather than allocating a
+	// new buffer for each stream.  This reduces allocation for workloads
+	// which open and close many short-lived streams.  A buffer is only reused
+	// once the stream is removed and its data has been read or discarded.
+	// Default: false
+	ReuseBuffers bool
+
+	// MaxFrameSize is the maximum size of the payload of a frame, in bytes.
+	// Larger frames received from the remote end are discarded without being
+	// buffered in memory, and the stream they belong to is reset.  Data
+	// written to streams is split into frames no larger than this, so both
+	// ends should use the same value.  Values less than or equal to zero
+	// select the default.
+	// Default: 1MiB (DefaultMaxFrameSize)
+	MaxFrameSize int
+
+	// MaxStreams is the maximum number of streams the session will track at
+	// once, including streams opened locally and streams initiated by the
+	// remote end.  Open fails with ErrTooManyStreams when this limit is
+	// reached, and new remote streams are refused.  Default: 0 (unlimited)
+	MaxStreams int
+
+	// MaxTotalBuffer bounds the memory used to buffer received data across
+	// all of the session's streams, in bytes.  Each stream reserves its
+	// receive window from this total for as long as the session tracks it,
+	// so the remote end can never send more than this much unread data.  When
+	// the total is reached, Open fails with ErrBufferLimit, new remote
+	// streams are refused, and SetReceiveWindow cannot grow a stream's
+	// window.  A paused stream (see Stream.Pause) keeps its reservation, and
+	// never buffers more than it.  Default: 0 (unlimited)
+	MaxTotalBuffer int
+
+	// AcceptQueueSize is the number of streams initiated by the remote end
+	// which may be waiting for Accept.  Further streams are refused until
+	// Accept is called.  Servers expecting bursts of new streams may wish to
+	// increase this.  Values less than or equal to zero select the default.
+	// Default: 200
+	AcceptQueueSize int
+
+	// AcceptQueueRetries is the number of times to retry queueing a new
+	// stream when the accept queue is full, waiting AcceptQueueRetryInterval
+	// between attempts, before refusing the stream.  This tolerates an
+	// application which is momentarily slow to call Accept.  Other frames are
+	// received normally while waiting.  Default: 0 (refuse immediately)
+	AcceptQueueRetries int
+
+	// AcceptQueueRetryInterval is the time to wait between attempts to queue
+	// a new stream; see AcceptQueueRetries.  Default: 10 milliseconds
+	AcceptQueueRetryInterval time.Duration
+
+	// StreamIdleTimeout is the time after which a stream on which no data has
+	// been received or written is reset and removed from the session.  Reads
+	// and writes on such a stream fail with ErrStreamClosed.
+	// Default: 0 (streams never time out)
+	StreamIdleTimeout time.Duration
+
+	// SessionIdleTimeout is the time after which a session with no streams,
+	// on which no frames have been received, closes itself.  This allows
+	// reclaiming sessions from peers which connected but never opened a
+	// stream.  Default: 0 (sessions never time out)
+	SessionIdleTimeout time.Duration
+
+	// OnIdleClose, if set, is called after CloseCallback when the session
+	// closes because of SessionIdleTimeout.
+	OnIdleClose func()
+
+	// InitialReceiveWindow is the amount of data the remote end may send on a
+	// new stream before the local application reads any of it.  It is
+	// advertised to the remote end both when opening and when accepting a
+	// stream, and overrides StreamBufferSize if set.
+	// Default: StreamBufferSize
+	InitialReceiveWindow int
+
+	// InitialSendWindow is the amount of data the session will send on a
+	// newly-accepted stream before receiving an ACK, for remote ends which do
+	// not advertise a receive window when opening the stream.  When the remote
+	// end advertises a window, whether opening or accepting, that is used
+	// instead.  Default: the receive window
+	InitialSendWindow int
+
+	// EnableCompression enables permessage-deflate compression of the frames
+	// written by the session.  Compression is only used if the extension was
+	// negotiated during the websocket handshake, so the upgrader or dialer must
+	// also set EnableCompression; `Dial` and `Upgrade` do so when this option
+	// is set.  Websocket control frames, such as keepalive pings, are never
+	// compressed.
+	// Default: false
+	EnableCompression bool
+
+	// CompressionLevel is the compression level used when EnableCompression
+	// is set; see compress/flate.  This can be changed later with
+	// `session.SetCompressionLevel(..)`.  Default: 0 (the websocket package
+	// default)
+	CompressionLevel int
+
+	// TextMessages carries frames as base64-encoded websocket text messages,
+	// rather than binary messages, for use through proxies which do not pass
+	// binary messages intact.  Both ends must set this option.  A session with
+	// this option set still accepts binary messages.  A session without it
+	// discards text messages, counting them in Stats().MessagesDropped.
+	// Default: false
+	TextMessages bool
+
+	// NegotiateVersion makes the session advertise the newest protocol
+	// version it supports, ProtocolVersion, in the first message it sends.
+	// When both ends advertise a version, the session uses the newest version
+	// both support, as reported by `session.Version()`, so that the frame
+	// format can evolve without breaking older peers.  If there is no such
+	// version, the session closes the connection with the
+	// CloseUnsupportedVersion close code, and both ends fail with
+	// ErrUnsupportedVersion.  A remote end which does not advertise a version
+	// is assumed to use version 1.  Only enable this when the remote end runs
+	// a version of wsmux that understands version messages; older versions
+	// discard the message as a protocol violation.  Default: false
+	NegotiateVersion bool
+
+	// FrameInterceptor, if set, is called for every frame received and every
+	// frame about to be sent.  If it returns an error for an inbound frame,
+	// the frame is dropped; for an outbound frame, the frame is not sent and
+	// the write fails with that error, leaving the stream unusable.  This can be used for auditing, rate limiting, or fault
+	// injection.  It is called from the session's internal goroutines, so it
+	// must not block for long.
+	FrameInterceptor func(dir Direction, f FrameInfo) error
+
+	// StrictProtocol closes the session when the remote end violates the
+	// protocol, for example by sending a malformed frame or exceeding a
+	// stream's receive window.  By default, such errors are logged and only
+	// the offending message is discarded, or the affected stream reset,
+	// leaving the rest of the session unaffected.  Strict mode is useful for
+	// catching bugs in either end.  Default: false
+	StrictProtocol bool
+
+	// OnProtocolError, if set, is called with a *ProtocolError whenever the
+	// remote end violates the protocol, whether or not StrictProtocol is set,
+	// so that violations can be counted by kind.  It is called from the
+	// session's receive loop, so it must not block.  Violations are also
+	// logged.
+	OnProtocolError func(err error)
+
+	// BatchWrites enables batching of stream writes.  Data written to streams
+	// is queued rather than written to the websocket immediately, and
+	// consecutive writes to the same stream are coalesced into a single
+	// frame.  Queued data is written every BatchFlushInterval, when it reaches
+	// BatchSize bytes, before any other frame is sent, or when
+	// `session.Flush()` is called.  With batching, an error writing queued
+	// data to the websocket may not be returned from Write; instead, it aborts
+	// the session.
+	//
+	// Frames queued together are sent in a single websocket message, up to
+	// MaxFrameSize, reducing framing overhead.  Only enable this when the
+	// remote end runs a version of wsmux that understands such messages.
+	// Default: false
+	BatchWrites bool
+
+	// BatchFlushInterval is the maximum time written data is queued when
+	// BatchWrites is set.  Default: 5ms
+	BatchFlushInterval time.Duration
+
+	// BatchSize is the number of queued bytes at which batched data is written
+	// immediately, when BatchWrites is set.  Default: 16KiB
+	BatchSize int
+
+	// AckThreshold coalesces the msgACK frames which replenish the remote
+	// end's send window as streams are read, reducing the frame rate on the
+	// reverse path when the application makes many small reads.  A Read
+	// sends a msgACK only once the credit to be granted reaches this fraction
+	// of the stream's receive window; smaller amounts accumulate, and are
+	// sent every AckFlushInterval.  Values greater than 1 are treated as 1.
+	// Default: 0 (every Read returning data sends a msgACK)
+	AckThreshold float64
+
+	// AckFlushInterval is the maximum time credit is withheld when
+	// AckThreshold is set.  Default: 5ms
+	AckFlushInterval time.Duration
+
+	// WriteTimeout is the time allowed for writing each frame to the
+	// websocket.  If a write does not complete in this time, for example
+	// because the remote end has stopped reading, the session is closed.
+	// Default: 0 (no timeout)
+	WriteTimeout time.Duration
+
+	// CloseFlushTimeout is the time Close waits for frames which are already
+	// queued, such as data from Write calls blocked behind other streams, to
+	// be written to the websocket before it closes the connection.  Frames
+	// still queued when it expires are discarded, and the calls which queued
+	// them fail with ErrSessionClosed.  Default: 0 (Close writes data queued
+	// by BatchWrites, waiting at most a second, but does not wait for the send
+	// queue)
+	CloseFlushTimeout time.Duration
+
+	// LeaveConnOpen stops the session from closing the websocket connection
+	// when it closes, for callers which manage the connection themselves.
+	// Close still kills all streams and stops the session's goroutines, and
+	// once it returns, the session no longer reads from or writes to the
+	// connection, and the caller is responsible for closing it.  To stop
+	// reading, Close interrupts the session's pending read, which leaves the
+	// connection unable to read further messages; it can still be written,
+	// for example to send a close message.  Any write in progress is allowed
+	// to complete, so set WriteTimeout if the remote end may stop reading, or
+	// Close may block indefinitely.
+	//
+	// This is the inverse of a ManageConn option defaulting to true, which
+	// cannot be expressed with Go's zero values: LeaveConnOpen: true is
+	// equivalent to ManageConn: false.  Default: false (the session owns the
+	// connection and closes it)
+	LeaveConnOpen bool
+
+	// ReadTimeout is the time allowed without receiving anything from the
+	// remote end, including frames, pings and pongs, before the session is
+	// closed.  This detects a remote end which has gone silent without closing
+	// the connection.  It should be longer than the KeepAliveInterval of both
+	// ends, plus their KeepAliveJitter, so that an idle but healthy session is
+	// not closed.  Without a
+	// ReadTimeout, a session is closed when pongs are not received for two
+	// keepalive intervals.  Default: 0 (no timeout)
+	ReadTimeout time.Duration
+
+	// HandshakeTimeout is the time allowed for the websocket handshake in
+	// `Dial`.  Negative values disable the timeout, leaving only the context
+	// passed to `Dial` to bound the handshake.  It has no effect on sessions
+	// created with `Server` or `Client`.  Default: 45 seconds
+	HandshakeTimeout time.Duration
+
+	// DialHeaders are additional HTTP headers sent with the websocket
+	// handshake in `Dial`, such as an Authorization header.  It has no effect
+	// on sessions created with `Server` or `Client`.
+	DialHeaders http.Header
+
+	// Subprotocols are the websocket subprotocols supported by the session,
+	// in order of preference, allowing peers to version the protocol they
+	// speak over wsmux.  `Dial` offers them to the server, and `Upgrade`
+	// selects the first of them offered by the client, rejecting clients
+	// which offer none of them before any frames are exchanged.  Use
+	// `session.Subprotocol()` to find the negotiated subprotocol.  They have
+	// no effect on sessions created with `Server` or `Client`.
+	// Default: nil (no subprotocol is negotiated)
+	Subprotocols []string
+
+	// TLSConfig configures TLS for `wss://` URLs in `Dial`, for example to
+	// trust a private CA or to present a client certificate for mutual TLS.
+	// It is ignored for `ws://` URLs, and has no effect on sessions created
+	// with `Server` or `Client`.  Default: nil (the crypto/tls defaults)
+	TLSConfig *tls.Config
+
+	// clock, if set, replaces the real clock for timeouts and intervals; this
+	// is only used in tests
+	clock clock
 }
 
 // Server instantiates a new server session over a websocket connection.
 //
-// This function takes ownership of `conn`; nothing else should use the connection.
+// This function takes ownership of `conn`; nothing else should use the
+// connection.  With Config.LeaveConnOpen, ownership returns to the caller when
+// Close returns.
 func Server(conn *websocket.Conn, conf Config) *Session {
-	return newSession(conn, true, conf)
+	return NewServer(conn, WithConfig(conf))
 }
 
 // Client instantiates a new client session over a websocket connection.
 //
-// This function takes ownership of `conn`; nothing else should use the connection.
+// This function takes ownership of `conn`; nothing else should use the
+// connection.  With Config.LeaveConnOpen, ownership returns to the caller when
+// Close returns.
 func Client(conn *websocket.Conn, conf Config) *Session {
-	return newSession(conn, false, conf)
+	return NewClient(conn, WithConfig(conf))
+}
+
+// Dial performs a websocket handshake with the server at url (a ws:// or
+// wss:// URL) and returns a new client session over the resulting connection.
+// The handshake fails if ctx is done before it completes.
+func Dial(ctx context.Context, url string, conf Config) (*Session, error) {
+	conn, _, err := conf.dialer().DialContext(ctx, url, conf.DialHeaders)
+	if err != nil {
+		return nil, err
+	}
+	return Client(conn, conf), nil
+}
+
+// Upgrade upgrades an HTTP request to the websocket protocol and returns a new
+// server session over the resulting connection; it is the server-side
+// counterpart of Dial.  If Config.Subprotocols is set and the client offers
+// none of them, the request is rejected with a 400 Bad Request response and
+// Upgrade fails with ErrUnsupportedSubprotocol.  On error, a response has been
+// written to w.
+func Upgrade(w http.ResponseWriter, r *http.Request, conf Config) (*Session, error) {
+	if len(conf.Subprotocols) > 0 && !offersSubprotocol(r, conf.Subprotocols) {
+		http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+		return nil, ErrUnsupportedSubprotocol
+	}
+	conn, err := conf.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, conf), nil
+}
+
+// offersSubprotocol returns true if the client offers any of the given
+// subprotocols
+func offersSubprotocol(r *http.Request, supported []string) bool {
+	for _, offered := range websocket.Subprotocols(r) {
+		for _, p := range supported {
+			if offered == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrader returns a websocket.Upgrader based on the configuration
+func (conf Config) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		EnableCompression: conf.EnableCompression,
+		Subprotocols:      conf.Subprotocols,
+	}
+}
+
+// dialer returns a websocket.Dialer based on the configuration
+func (conf Config) dialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if conf.HandshakeTimeout < 0 {
+		dialer.HandshakeTimeout = 0
+	} else if conf.HandshakeTimeout != 0 {
+		dialer.HandshakeTimeout = conf.HandshakeTimeout
+	}
+	if conf.EnableCompression {
+		dialer.EnableCompression = true
+	}
+	if conf.TLSConfig != nil {
+		dialer.TLSClientConfig = conf.TLSConfig
+	}
+	if conf.Subprotocols != nil {
+		dialer.Subprotocols = conf.Subprotocols
+	}
+	return &dialer
 }
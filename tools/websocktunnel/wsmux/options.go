@@ -0,0 +1,131 @@
+package wsmux
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+// Option configures a session created with NewServer or NewClient.  Options
+// are applied in order to an empty Config, so where two options set the same
+// field, the later one wins.  Fields without an option of their own can be
+// set with WithConfig.
+type Option func(*Config)
+
+// NewServer instantiates a new server session over a websocket connection,
+// configured by the given options.  It is equivalent to Server with the
+// resulting Config, and takes ownership of `conn` in the same way.
+func NewServer(conn *websocket.Conn, opts ...Option) *Session {
+	return newSession(conn, true, newConfig(opts))
+}
+
+// NewClient instantiates a new client session over a websocket connection,
+// configured by the given options.  It is equivalent to Client with the
+// resulting Config, and takes ownership of `conn` in the same way.
+func NewClient(conn *websocket.Conn, opts ...Option) *Session {
+	return newSession(conn, false, newConfig(opts))
+}
+
+// newConfig applies opts to an empty Config
+func newConfig(opts []Option) Config {
+	var conf Config
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return conf
+}
+
+// WithConfig replaces the whole configuration with conf, so it should come
+// before any other options.  This allows an existing Config to be used with
+// NewServer and NewClient, and sets fields which have no option of their own.
+func WithConfig(conf Config) Option {
+	return func(c *Config) {
+		*c = conf
+	}
+}
+
+// WithKeepAlive sets the interval between keepalives, as for
+// Config.KeepAliveInterval.  Unlike that field, an interval of zero or less
+// disables keepalives rather than selecting the default.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(c *Config) {
+		if interval <= 0 {
+			interval = -1
+		}
+		c.KeepAliveInterval = interval
+	}
+}
+
+// WithLogger sets the logger and the level of messages written to it, as for
+// Config.Log and Config.LogLevel.
+func WithLogger(log util.Logger, level LogLevel) Option {
+	return func(c *Config) {
+		c.Log = log
+		c.LogLevel = level
+	}
+}
+
+// WithMaxStreams limits the number of streams the session tracks at once, as
+// for Config.MaxStreams.
+func WithMaxStreams(n int) Option {
+	return func(c *Config) {
+		c.MaxStreams = n
+	}
+}
+
+// WithStreamBufferSize sets the receive window of new streams, as for
+// Config.StreamBufferSize.
+func WithStreamBufferSize(n int) Option {
+	return func(c *Config) {
+		c.StreamBufferSize = n
+	}
+}
+
+// WithMaxFrameSize sets the maximum frame payload size, as for
+// Config.MaxFrameSize.
+func WithMaxFrameSize(n int) Option {
+	return func(c *Config) {
+		c.MaxFrameSize = n
+	}
+}
+
+// WithStreamAcceptDeadline sets the time after which opening a stream times
+// out, as for Config.StreamAcceptDeadline.  Unlike that field, a deadline of
+// zero or less disables the deadline rather than selecting the default.
+func WithStreamAcceptDeadline(d time.Duration) Option {
+	return func(c *Config) {
+		if d <= 0 {
+			d = -1
+		}
+		c.StreamAcceptDeadline = d
+	}
+}
+
+// WithCloseCallback sets a function to be called when the session closes, as
+// for Config.CloseCallback.
+func WithCloseCallback(f func()) Option {
+	return func(c *Config) {
+		c.CloseCallback = f
+	}
+}
+
+// WithBatchWrites enables write batching, flushing queued data at least every
+// interval, or once size bytes are queued, as for Config.BatchWrites.  Zero
+// values select the defaults.
+func WithBatchWrites(interval time.Duration, size int) Option {
+	return func(c *Config) {
+		c.BatchWrites = true
+		c.BatchFlushInterval = interval
+		c.BatchSize = size
+	}
+}
+
+// WithCompression enables permessage-deflate compression at the given level,
+// as for Config.EnableCompression and Config.CompressionLevel.
+func WithCompression(level int) Option {
+	return func(c *Config) {
+		c.EnableCompression = true
+		c.CompressionLevel = level
+	}
+}
@@ -0,0 +1,102 @@
+package wsmux
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+func TestOptions(t *testing.T) {
+	conf := newConfig([]Option{
+		WithConfig(Config{MaxStreams: 1, ReadTimeout: time.Minute}),
+		WithMaxStreams(10),
+		WithStreamBufferSize(4096),
+		WithKeepAlive(0),
+		WithBatchWrites(0, 1024),
+	})
+	if conf.MaxStreams != 10 {
+		t.Fatalf("expected later option to win, got MaxStreams %d", conf.MaxStreams)
+	}
+	if conf.ReadTimeout != time.Minute {
+		t.Fatal("expected ReadTimeout from WithConfig")
+	}
+	if conf.StreamBufferSize != 4096 {
+		t.Fatalf("expected StreamBufferSize 4096, got %d", conf.StreamBufferSize)
+	}
+	if conf.KeepAliveInterval >= 0 {
+		t.Fatalf("expected keepalives to be disabled, got %v", conf.KeepAliveInterval)
+	}
+	if !conf.BatchWrites || conf.BatchSize != 1024 {
+		t.Fatal("expected batching with a 1024-byte batch size")
+	}
+
+	// WithConfig replaces everything set before it
+	conf = newConfig([]Option{WithMaxStreams(10), WithConfig(Config{})})
+	if conf.MaxStreams != 0 {
+		t.Fatalf("expected WithConfig to replace MaxStreams, got %d", conf.MaxStreams)
+	}
+}
+
+func TestNewClientServer(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := NewServer(conn, WithLogger(genLogger(), LogLevelDebug), WithStreamBufferSize(4096))
+		str, err := session.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(str, str)
+		_ = str.Close()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	session := NewClient(conn, WithLogger(genLogger(), LogLevelDebug), WithCloseCallback(func() { close(closed) }))
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWithData([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, str); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" {
+		t.Fatalf("bad message %q", buf.String())
+	}
+
+	_ = session.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close callback was not called")
+	}
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, silentConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewClient(conn, WithLogger(genLogger(), LogLevelInfo), WithKeepAlive(0))
+	defer session.Close()
+
+	// the remote end never answers pings, which would close the session
+	// within two intervals if keepalives were sent
+	time.Sleep(300 * time.Millisecond)
+	if session.IsClosed() {
+		t.Fatalf("session closed without keepalives: %v", session.Err())
+	}
+}
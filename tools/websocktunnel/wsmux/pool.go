@@ -0,0 +1,113 @@
+package wsmux
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool spreads streams across several sessions, each over its own websocket
+// connection.  This avoids head-of-line blocking between unrelated streams and
+// allows more throughput than a single connection.
+//
+// Sessions are created on demand with the dial function given to NewPool, and
+// a session which has closed is transparently replaced the next time it would
+// be used.  A Pool is only used to open streams; streams initiated by the
+// remote end of the member sessions are not accepted.
+type Pool struct {
+	mu       sync.Mutex
+	dial     func(context.Context) (*Session, error)
+	sessions []*Session
+	next     int
+	closed   bool
+}
+
+// NewPool creates a pool of up to `size` sessions, created with `dial`.  No
+// sessions are created until the first call to Open.
+func NewPool(size int, dial func(context.Context) (*Session, error)) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		dial:     dial,
+		sessions: make([]*Session, size),
+	}
+}
+
+// Open opens a new stream on one of the pool's sessions.
+func (p *Pool) Open() (Stream, error) {
+	return p.OpenContext(context.Background())
+}
+
+// OpenContext opens a new stream on one of the pool's sessions, choosing
+// sessions in round-robin order.  If the chosen session is not yet connected,
+// or has closed, it is replaced by dialing a new one.  The context applies to
+// both dialing and opening the stream.
+func (p *Pool) OpenContext(ctx context.Context) (Stream, error) {
+	session, err := p.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.OpenContext(ctx)
+}
+
+// session returns the next session to use, dialing a replacement if necessary
+func (p *Pool) session(ctx context.Context) (*Session, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	i := p.next
+	p.next = (p.next + 1) % len(p.sessions)
+	session := p.sessions[i]
+	p.mu.Unlock()
+
+	if session != nil && !session.IsClosed() {
+		return session, nil
+	}
+
+	// dial without holding the lock, so that other slots remain usable
+	session, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		_ = session.Close()
+		return nil, ErrPoolClosed
+	}
+	// another caller may have replaced this session concurrently
+	if cur := p.sessions[i]; cur != nil && !cur.IsClosed() {
+		_ = session.Close()
+		return cur, nil
+	}
+	p.sessions[i] = session
+	return session, nil
+}
+
+// Close closes the pool and all of its sessions.  It returns the first error
+// encountered closing a session.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	sessions := p.sessions
+	p.sessions = nil
+	p.mu.Unlock()
+
+	var err error
+	for _, session := range sessions {
+		if session == nil {
+			continue
+		}
+		if e := session.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package wsmux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+func TestPool(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	var dials int32
+	pool := NewPool(2, func(ctx context.Context) (*Session, error) {
+		atomic.AddInt32(&dials, 1)
+		return Dial(ctx, util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	})
+	defer pool.Close()
+
+	echo := func() {
+		str, err := pool.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := str.Write([]byte("Hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := str.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		final := new(bytes.Buffer)
+		if _, err := io.Copy(final, str); err != nil {
+			t.Fatal(err)
+		}
+		if final.String() != "Hello" {
+			t.Fatalf("bad message %q", final.String())
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		echo()
+	}
+	if d := atomic.LoadInt32(&dials); d != 2 {
+		t.Fatalf("expected 2 dials, got %d", d)
+	}
+
+	// a closed session is replaced
+	pool.mu.Lock()
+	closed := pool.sessions[pool.next]
+	pool.mu.Unlock()
+	_ = closed.Close()
+	echo()
+	if d := atomic.LoadInt32(&dials); d != 3 {
+		t.Fatalf("expected 3 dials, got %d", d)
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Open(); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package wsmux
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultReconnectMinBackoff = 100 * time.Millisecond
+	defaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// ResilientSession opens streams over a session which is re-established when
+// it is lost.  If the session closes abnormally, that is, neither locally nor
+// by the remote end sending a normal-closure close code, a new session is
+// dialed in the background, retrying with exponential backoff until it
+// succeeds.  After a clean close, no new session is dialed until the next call
+// to Open.
+//
+// Streams belonging to a lost session fail as usual, and cannot be resumed;
+// only streams opened after the reconnection use the new session.  Like Pool,
+// a ResilientSession is only used to open streams.
+type ResilientSession struct {
+	mu      sync.Mutex
+	dial    func(context.Context) (*Session, error)
+	session *Session
+	closed  bool
+
+	// closed when the ResilientSession is closed, to stop reconnecting
+	done chan struct{}
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// NewResilientSession creates a ResilientSession which creates sessions with
+// `dial`.  No session is created until the first call to Open.
+func NewResilientSession(dial func(context.Context) (*Session, error)) *ResilientSession {
+	return &ResilientSession{
+		dial:       dial,
+		done:       make(chan struct{}),
+		minBackoff: defaultReconnectMinBackoff,
+		maxBackoff: defaultReconnectMaxBackoff,
+	}
+}
+
+// Open opens a new stream on the current session.
+func (r *ResilientSession) Open() (Stream, error) {
+	return r.OpenContext(context.Background())
+}
+
+// OpenContext opens a new stream on the current session, first dialing a new
+// session if there is none or it has closed.  The context applies to both
+// dialing and opening the stream.
+func (r *ResilientSession) OpenContext(ctx context.Context) (Stream, error) {
+	session, err := r.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.OpenContext(ctx)
+}
+
+// Session returns the current underlying session, which may be nil or closed
+// if no session has been established or a reconnection is in progress.
+func (r *ResilientSession) Session() *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.session
+}
+
+// current returns the current session, dialing a new one if necessary
+func (r *ResilientSession) current(ctx context.Context) (*Session, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	session := r.session
+	r.mu.Unlock()
+
+	if session != nil && !session.IsClosed() {
+		return session, nil
+	}
+
+	session, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.install(session)
+}
+
+// install makes session the current session, unless another session was
+// installed concurrently, in which case that session is returned instead.
+func (r *ResilientSession) install(session *Session) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		_ = session.Close()
+		return nil, ErrSessionClosed
+	}
+	if cur := r.session; cur != nil && !cur.IsClosed() {
+		_ = session.Close()
+		return cur, nil
+	}
+	r.session = session
+	go r.watch(session)
+	return session, nil
+}
+
+// watch waits for session to close, and reconnects if it closed abnormally
+func (r *ResilientSession) watch(session *Session) {
+	select {
+	case <-r.done:
+		return
+	case <-session.closed:
+	}
+
+	if closedCleanly(session) {
+		session.logger.Infof("session closed cleanly; not reconnecting")
+		return
+	}
+
+	backoff := r.minBackoff
+	for {
+		session.logger.Infof("session closed abnormally; reconnecting in %v", backoff)
+		select {
+		case <-r.done:
+			return
+		case <-session.clock.After(backoff):
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-r.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		next, err := r.dial(ctx)
+		cancel()
+		if err == nil {
+			// install starts a new watcher for the new session
+			_, _ = r.install(next)
+			return
+		}
+		session.logger.Errorf("reconnecting session: %v", err)
+
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// closedCleanly returns true if session was closed with a normal-closure
+// close code from the remote end, or was closed locally, for example by
+// Close, CloseGracefully or Config.SessionIdleTimeout, rather than aborted by an
+// error.
+func closedCleanly(session *Session) bool {
+	code, _ := session.CloseError()
+	if code == websocket.CloseNormalClosure {
+		return true
+	}
+	return code == 0 && session.Err() == ErrSessionClosed
+}
+
+// Close closes the current session, and stops any reconnection.
+func (r *ResilientSession) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	session := r.session
+	r.session = nil
+	r.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+	return session.Close()
+}
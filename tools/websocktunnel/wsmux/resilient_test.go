@@ -0,0 +1,176 @@
+package wsmux
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+func TestResilientSessionReconnects(t *testing.T) {
+	var conns int32
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		if atomic.AddInt32(&conns, 1) == 1 {
+			// drop the first connection without a close frame
+			_ = conn.Close()
+			return
+		}
+		acceptEchoConn(t, conn)
+	}))
+	defer server.Close()
+
+	var dials int32
+	r := NewResilientSession(func(ctx context.Context) (*Session, error) {
+		atomic.AddInt32(&dials, 1)
+		return Dial(ctx, util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	})
+	r.minBackoff = 10 * time.Millisecond
+	defer r.Close()
+
+	// establish the first session, which the server drops
+	first, err := r.current(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cur := r.Session(); cur == first || cur.IsClosed(); cur = r.Session() {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not re-dialed after an abnormal close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	str, err := r.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = str.Close()
+	if d := atomic.LoadInt32(&dials); d != 2 {
+		t.Fatalf("expected 2 dials, got %d", d)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Open(); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestResilientSessionCleanClose(t *testing.T) {
+	var conns int32
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		if atomic.AddInt32(&conns, 1) == 1 {
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			_ = conn.Close()
+			return
+		}
+		acceptEchoConn(t, conn)
+	}))
+	defer server.Close()
+
+	var dials int32
+	r := NewResilientSession(func(ctx context.Context) (*Session, error) {
+		atomic.AddInt32(&dials, 1)
+		return Dial(ctx, util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	})
+	r.minBackoff = 10 * time.Millisecond
+	defer r.Close()
+
+	first, err := r.current(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.closed:
+	case <-time.After(time.Second):
+		t.Fatal("session did not close")
+	}
+
+	// no reconnection happens in the background..
+	time.Sleep(100 * time.Millisecond)
+	if d := atomic.LoadInt32(&dials); d != 1 {
+		t.Fatalf("expected no reconnection, got %d dials", d)
+	}
+
+	// ..but Open dials a new session
+	str, err := r.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = str.Close()
+	if d := atomic.LoadInt32(&dials); d != 2 {
+		t.Fatalf("expected 2 dials, got %d", d)
+	}
+}
+
+func TestResilientSessionLocalClose(t *testing.T) {
+	for name, closeSession := range map[string]func(*Session){
+		"Close": func(s *Session) { _ = s.Close() },
+		"CloseGracefully": func(s *Session) {
+			_ = s.CloseGracefully(context.Background())
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+			defer server.Close()
+
+			var dials int32
+			r := NewResilientSession(func(ctx context.Context) (*Session, error) {
+				atomic.AddInt32(&dials, 1)
+				return Dial(ctx, util.MakeWsURL(server.URL), Config{Log: genLogger()})
+			})
+			r.minBackoff = 10 * time.Millisecond
+			defer r.Close()
+
+			first, err := r.current(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeSession(first)
+
+			// a session closed locally is not re-dialed in the background
+			time.Sleep(100 * time.Millisecond)
+			if d := atomic.LoadInt32(&dials); d != 1 {
+				t.Fatalf("expected no reconnection, got %d dials", d)
+			}
+		})
+	}
+}
+
+func TestResilientSessionBackoffFakeClock(t *testing.T) {
+	var conns int32
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		if atomic.AddInt32(&conns, 1) == 1 {
+			_ = conn.Close()
+			return
+		}
+		acceptEchoConn(t, conn)
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	redialed := make(chan struct{})
+	var dials int32
+	r := NewResilientSession(func(ctx context.Context) (*Session, error) {
+		if atomic.AddInt32(&dials, 1) == 2 {
+			close(redialed)
+		}
+		return Dial(ctx, util.MakeWsURL(server.URL), Config{Log: genLogger(), clock: clock})
+	})
+	r.minBackoff = time.Hour
+	defer r.Close()
+
+	if _, err := r.current(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backoff is timed by the session's clock
+	advanceUntil(t, clock, time.Hour, redialed)
+}
@@ -0,0 +1,141 @@
+package wsmux
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPriority is the priority of new streams; see stream.SetPriority
+	DefaultPriority uint8 = 128
+
+	// frames other than msgDAT are sent ahead of all data
+	controlPriority = 256
+	numPriorities   = controlPriority + 1
+)
+
+// sendRequest is a frame waiting to be written by the session's writeLoop.  A
+// flush request carries no frame, and completes once everything queued ahead
+// of it has been written.
+type sendRequest struct {
+	f     frame
+	flush bool
+	done  chan error
+}
+
+// sendQueue holds frames waiting to be written, ordered by strict priority.
+// Frames of equal priority are written in the order they were queued.
+type sendQueue struct {
+	mu      sync.Mutex
+	queues  [numPriorities][]*sendRequest
+	pending int
+
+	// signalled (without blocking) when a request is pushed
+	ready chan struct{}
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{ready: make(chan struct{}, 1)}
+}
+
+// push adds a request to the queue at the given priority
+func (q *sendQueue) push(priority int, r *sendRequest) {
+	q.mu.Lock()
+	q.queues[priority] = append(q.queues[priority], r)
+	q.pending++
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the oldest request with the highest priority, or nil
+// if the queue is empty
+func (q *sendQueue) pop() *sendRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == 0 {
+		return nil
+	}
+	for p := numPriorities - 1; p >= 0; p-- {
+		if len(q.queues[p]) > 0 {
+			r := q.queues[p][0]
+			q.queues[p][0] = nil
+			q.queues[p] = q.queues[p][1:]
+			q.pending--
+			return r
+		}
+	}
+	return nil
+}
+
+// sendAt queues a frame at the given priority and waits for writeLoop to write
+// it, returning any error from the write.
+func (s *Session) sendAt(f frame, priority int) error {
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+
+	r := &sendRequest{f: f, done: make(chan error, 1)}
+	s.sendQueue.push(priority, r)
+
+	select {
+	case err := <-r.done:
+		return err
+	case <-s.closed:
+		// prefer the result of the write, if it completed
+		select {
+		case err := <-r.done:
+			return err
+		default:
+			return ErrSessionClosed
+		}
+	}
+}
+
+// writeLoop sits in a goroutine and writes queued frames to the websocket
+// connection, highest priority first.
+func (s *Session) writeLoop() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.sendQueue.ready:
+		}
+
+		for r := s.sendQueue.pop(); r != nil; r = s.sendQueue.pop() {
+			s.sendLock.Lock()
+			// any batched data must be written first, to preserve frame order
+			err := s.flushLocked()
+			if err == nil && !r.flush {
+				err = s.writeFrame(r.f)
+			}
+			s.sendLock.Unlock()
+			r.done <- err
+		}
+	}
+}
+
+// drainSendQueue waits until every frame queued so far, including batched
+// data, has been written, or until the timeout expires.  Frames are written in
+// priority order, so the wait also covers frames of higher priority which are
+// queued meanwhile.
+func (s *Session) drainSendQueue(timeout time.Duration) error {
+	r := &sendRequest{flush: true, done: make(chan error, 1)}
+	s.sendQueue.push(0, r)
+
+	timer := s.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-r.done:
+		return err
+	case <-timer.C():
+		return ErrWriteTimeout
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+}
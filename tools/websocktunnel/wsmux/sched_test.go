@@ -0,0 +1,31 @@
+package wsmux
+
+import (
+	"testing"
+)
+
+func TestSendQueueOrder(t *testing.T) {
+	q := newSendQueue()
+	push := func(priority int, id uint32) {
+		q.push(priority, &sendRequest{f: frame{id: id}})
+	}
+	push(int(DefaultPriority), 1)
+	push(0, 2)
+	push(255, 3)
+	push(int(DefaultPriority), 4)
+	push(controlPriority, 5)
+
+	expected := []uint32{5, 3, 1, 4, 2}
+	for _, id := range expected {
+		r := q.pop()
+		if r == nil {
+			t.Fatalf("queue empty; expected frame for stream %d", id)
+		}
+		if r.f.id != id {
+			t.Fatalf("expected frame for stream %d, got %d", id, r.f.id)
+		}
+	}
+	if r := q.pop(); r != nil {
+		t.Fatalf("expected empty queue, got frame for stream %d", r.f.id)
+	}
+}
@@ -1,27 +1,82 @@
 package wsmux
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
 )
 
 const (
-	defaultStreamQueueSize      = 200              // size of the accept stream
-	defaultKeepAliveInterval    = 20 * time.Second // keep alive interval
-	defaultStreamAcceptDeadline = 30 * time.Second // If stream is not accepted within this deadline then timeout
-	deadCheckDuration           = 2 * time.Second  // check for dead streams every 2 seconds
+	defaultStreamQueueSize      = 200                   // size of the accept stream
+	pingWriteTimeout            = 10 * time.Second      // time allowed to send a ping from Ping
+	defaultKeepAliveInterval    = 20 * time.Second      // keep alive interval
+	defaultKeepAliveJitter      = 0.1                   // vary keepalive intervals by up to 10%
+	maxKeepAliveJitter          = 0.5                   // larger jitter is reduced to this
+	defaultStreamAcceptDeadline = 30 * time.Second      // If stream is not accepted within this deadline then timeout
+	deadCheckDuration           = 2 * time.Second       // check for dead streams every 2 seconds
+	drainCheckDuration          = 50 * time.Millisecond // check for drained streams during CloseGracefully
+	defaultAcceptRetryInterval  = 10 * time.Millisecond // wait between attempts to queue a new stream
+	defaultBatchFlushInterval   = 5 * time.Millisecond  // maximum delay of batched writes
+	defaultBatchSize            = 16 * 1024             // flush batched writes at this many bytes
+	defaultAckFlushInterval     = 5 * time.Millisecond  // maximum delay of coalesced ACKs
+	coalesceDelay               = 5 * time.Millisecond  // maximum delay of coalesced stream writes; see SetNoDelay
+	coalesceSize                = 16 * 1024             // send coalesced stream writes at this many bytes
+	closeFlushWait              = time.Second           // maximum wait for Close to write batched data
 )
 
+// messageBufferPool holds buffers for incoming websocket messages
+var messageBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 // Session allows creating and accepting wsmux streams over a websocket connection.
 // It is created with the `wsmux.Server` or `wsmux.Client` functions.
 //
-// Session implements net.Listener
+// Session implements net.Listener, and the streams it accepts implement the
+// full net.Conn contract, including deadlines, so a Session can be passed to
+// http.Server.Serve to serve HTTP with one connection per stream.
+//
+// All methods of a Session are safe to call concurrently from multiple
+// goroutines, including Open and Accept with each other and with Close.  Once
+// Close has begun, Open and Accept calls, including those already blocked,
+// fail with ErrSessionClosed, unless the remote end had already accepted the
+// stream being opened, and streams already returned are killed, as described
+// for Close.  Similarly, all methods of a Stream may be called concurrently, but
+// concurrent Read calls, or concurrent Write calls, each receive or send
+// parts of the data in an unspecified order.
 type Session struct {
-	// lock for channels and stream map
+	// counters for Stats(); this is the first field to guarantee 64-bit
+	// alignment for atomic operations
+	stats sessionStats
+
+	// time the last frame was received, in UnixNano; accessed atomically, and
+	// also 64-bit aligned
+	lastReceived int64
+
+	// smoothed round-trip time of keepalive pings, in nanoseconds; written only
+	// by pongHandler, and read atomically by RTT
+	rtt int64
+
+	// total receive window reserved by the session's streams; accessed
+	// atomically.  See Config.MaxTotalBuffer.
+	reservedBuffer int64
+
+	// lock for channels and stream map.  Locks are always acquired in the
+	// order mu, then a stream's m, then sendLock, then abortMu, and no lock is
+	// held while calling a callback other than FrameInterceptor.
 	mu sync.Mutex
 
 	// established streams, indexed by stream id. Streams opened by the server
@@ -39,293 +94,1312 @@ type Session struct {
 	// error to be returned by any outstanding Accept calls
 	acceptErr error
 
-	// lock for sending data on the connection
+	// the reason the session closed, returned by Err; this is set before
+	// s.closed is closed
+	closeErr error
+
+	// lock for sending data on the connection.  Gorilla allows only one
+	// concurrent writer, so every write made outside recvLoop, including
+	// pings, is made while holding this lock; see writeControl.
 	sendLock sync.Mutex
 
 	// Open calls must complete in this duration
 	streamAcceptDeadline time.Duration
 
+	// resends of msgSYN frames by Open; see Config.SynRetransmits
+	synRetransmits        int
+	synRetransmitInterval time.Duration
+
 	// Log drain
-	logger util.Logger
+	logger *leveledLogger
 
 	// id of next stream opened by session. increment by 2
 	// default: 0 for server, 1 for client
+	// protected by mu; it is only ever advanced, never rolled back
 	nextID uint32
 
+	// true for a session created with Server, which opens streams with even
+	// ids; immutable, so it can be read without holding mu
+	server bool
+
 	// channel to indicate that the connection is closed
 	closed chan struct{}
 
 	// used by Close(). If true then conn must be closed. default: true
 	closeConn bool
 
+	// leave the connection open on Close; see Config.LeaveConnOpen
+	leaveConnOpen bool
+
+	// set under sendLock once the session has closed with leaveConnOpen,
+	// after which the connection must not be written
+	connReleased bool
+
+	// closed when recvLoop returns
+	recvDone chan struct{}
+
+	// tracks the session's goroutines, for Shutdown; see spawn
+	goroutines sync.WaitGroup
+
+	// held while closing s.closed, so that abortAsync cannot spawn a goroutine
+	// after Shutdown has begun waiting; only ever acquired last
+	abortMu sync.Mutex
+
 	// Callback when remote session is closed. default: nil
 	closeCallback func()
 
+	// Callback when the session is closed by the remote end. default: nil
+	remoteCloseCallback func()
+
+	// Callbacks when streams are added to or removed from the session.
+	// default: nil
+	onStreamOpen  func(id uint32)
+	onStreamClose func(id uint32)
+
+	// see Config.OnAccept
+	onAccept func(id uint32) (window uint32, accept bool)
+
 	// Buffer size of each stream.  This is used to apply backpressure
 	// to the remote end, avoiding buffering too much data.
 	streamBufferSize int
 
-	// Keep alives are sent at this period
+	// stream buffers of streamBufferSize bytes, reused across streams; nil
+	// unless Config.ReuseBuffers is set
+	bufferPool *sync.Pool
+
+	// Send window assumed for accepted streams whose SYN did not advertise one
+	initialSendWindow int
+
+	// Keep alives are sent at this period; zero if keepalives are disabled
 	keepAliveInterval time.Duration
 
+	// each keepalive interval varies randomly by up to this fraction
+	keepAliveJitter float64
+
+	// Maximum number of streams in the streams map; 0 means unlimited
+	maxStreams int
+
+	// limit on reservedBuffer, or 0; see Config.MaxTotalBuffer
+	maxTotalBuffer int64
+
+	// Streams with no activity for this duration are reset; 0 means never
+	streamIdleTimeout time.Duration
+
+	// The session closes if it has no streams and receives no frames for this
+	// duration; 0 means never
+	sessionIdleTimeout time.Duration
+	onIdleClose        func()
+
 	// Set by the pong handler
 	pongSeen bool
+
+	// outstanding calls to Ping, keyed by the sequence number carried in
+	// the ping payload; protected by mu
+	pings   map[uint64]chan struct{}
+	pingSeq uint64
+
+	// true when the session is draining, and new streams are refused; see
+	// StartDraining.  drainingCh is closed at the same time.
+	draining   bool
+	drainingCh chan struct{}
+
+	// close code and reason received from the remote end; see CloseError
+	closeCode   int
+	closeReason string
+
+	// see Config.FrameInterceptor
+	frameInterceptor func(Direction, FrameInfo) error
+
+	// close the session on protocol violations; see Config.StrictProtocol
+	strictProtocol bool
+
+	// callback for protocol violations; see Config.OnProtocolError
+	onProtocolError func(err error)
+
+	// retries when the accept queue is full; see Config.AcceptQueueRetries
+	acceptRetries       int
+	acceptRetryInterval time.Duration
+
+	// time allowed for each websocket write; see Config.WriteTimeout
+	writeTimeout time.Duration
+
+	// time Close waits for queued frames; see Config.CloseFlushTimeout
+	closeFlushTimeout time.Duration
+
+	// time allowed between reads; see Config.ReadTimeout
+	readTimeout time.Duration
+
+	// maximum size of a frame payload; see Config.MaxFrameSize
+	maxFrameSize int
+
+	// frames are sent base64-encoded in text messages; see Config.TextMessages
+	textMessages bool
+
+	// advertise a protocol version; see Config.NegotiateVersion
+	negotiateVersion bool
+
+	// the negotiated protocol version; written only by recvLoop, and read
+	// atomically by Version
+	version uint32
+
+	// write batching configuration; see Config.BatchWrites
+	batchWrites        bool
+	batchFlushInterval time.Duration
+	batchSize          int
+
+	// ACK coalescing configuration; see Config.AckThreshold
+	ackThreshold     float64
+	ackFlushInterval time.Duration
+
+	// source of time for timeouts and intervals; see clock
+	clock clock
+
+	// frames waiting to be written by writeLoop
+	sendQueue *sendQueue
+
+	// pending DAT frames, and the number of bytes they contain; protected by
+	// sendLock
+	batch      []frame
+	batchBytes int
 }
 
 // newSession creates a new session based on the given configuration, applying
 // defaults as necessary.
 func newSession(conn *websocket.Conn, server bool, conf Config) *Session {
+	acceptQueueSize := defaultStreamQueueSize
+	if conf.AcceptQueueSize > 0 {
+		acceptQueueSize = conf.AcceptQueueSize
+	}
 	s := &Session{
 		conn:                 conn,
 		streams:              make(map[uint32]*stream),
-		streamCh:             make(chan *stream, defaultStreamQueueSize),
+		pings:                make(map[uint64]chan struct{}),
+		streamCh:             make(chan *stream, acceptQueueSize),
 		closed:               make(chan struct{}),
-		closeConn:            true,
+		drainingCh:           make(chan struct{}),
+		clock:                realClock{},
+		sendQueue:            newSendQueue(),
+		closeConn:            !conf.LeaveConnOpen,
+		leaveConnOpen:        conf.LeaveConnOpen,
+		recvDone:             make(chan struct{}),
 		nextID:               0,
 		keepAliveInterval:    defaultKeepAliveInterval,
 		streamAcceptDeadline: defaultStreamAcceptDeadline,
-		logger:               &util.NilLogger{},
+		logger:               newLeveledLogger(conf.Log, conf.LogLevel),
 		streamBufferSize:     DefaultCapacity,
 		closeCallback:        conf.CloseCallback,
+		remoteCloseCallback:  conf.RemoteCloseCallback,
+		onStreamOpen:         conf.OnStreamOpen,
+		onStreamClose:        conf.OnStreamClose,
+		onAccept:             conf.OnAccept,
 	}
 
 	// streams opened by server are even numbered
 	// streams opened by client are odd numbered
+	s.server = server
 	if !server {
 		s.nextID = 1
 	}
 
-	if conf.KeepAliveInterval != 0 {
+	if conf.KeepAliveInterval < 0 {
+		s.keepAliveInterval = 0
+	} else if conf.KeepAliveInterval != 0 {
 		s.keepAliveInterval = conf.KeepAliveInterval
 	}
-	if conf.StreamAcceptDeadline != 0 {
-		s.streamAcceptDeadline = conf.StreamAcceptDeadline
+	switch {
+	case conf.KeepAliveJitter < 0:
+		s.keepAliveJitter = 0
+	case conf.KeepAliveJitter == 0:
+		s.keepAliveJitter = defaultKeepAliveJitter
+	case conf.KeepAliveJitter > maxKeepAliveJitter:
+		s.keepAliveJitter = maxKeepAliveJitter
+	default:
+		s.keepAliveJitter = conf.KeepAliveJitter
 	}
-	if conf.Log != nil {
-		s.logger = conf.Log
+	if conf.StreamAcceptDeadline < 0 {
+		s.streamAcceptDeadline = 0
+	} else if conf.StreamAcceptDeadline != 0 {
+		s.streamAcceptDeadline = conf.StreamAcceptDeadline
 	}
 
-	if conf.StreamBufferSize != 0 {
+	if conf.StreamBufferSize > 0 {
 		s.streamBufferSize = conf.StreamBufferSize
 	}
+	s.maxFrameSize = DefaultMaxFrameSize
+	if conf.MaxFrameSize > 0 {
+		s.maxFrameSize = conf.MaxFrameSize
+	}
+	if conf.InitialReceiveWindow > 0 {
+		s.streamBufferSize = conf.InitialReceiveWindow
+	}
+	s.initialSendWindow = s.streamBufferSize
+	if conf.ReuseBuffers {
+		size := s.streamBufferSize
+		s.bufferPool = &sync.Pool{New: func() interface{} { return newBuffer(size) }}
+	}
+	if conf.InitialSendWindow > 0 {
+		s.initialSendWindow = conf.InitialSendWindow
+	}
+	if conf.MaxStreams > 0 {
+		s.maxStreams = conf.MaxStreams
+	}
+	if conf.MaxTotalBuffer > 0 {
+		s.maxTotalBuffer = int64(conf.MaxTotalBuffer)
+	}
+	if conf.StreamIdleTimeout > 0 {
+		s.streamIdleTimeout = conf.StreamIdleTimeout
+	}
+	s.synRetransmits = conf.SynRetransmits
+	s.synRetransmitInterval = conf.SynRetransmitInterval
+	if s.synRetransmits > 0 && s.synRetransmitInterval <= 0 {
+		deadline := s.streamAcceptDeadline
+		if deadline == 0 {
+			deadline = defaultStreamAcceptDeadline
+		}
+		s.synRetransmitInterval = deadline / time.Duration(s.synRetransmits+1)
+	}
+	s.acceptRetries = conf.AcceptQueueRetries
+	s.acceptRetryInterval = defaultAcceptRetryInterval
+	if conf.AcceptQueueRetryInterval > 0 {
+		s.acceptRetryInterval = conf.AcceptQueueRetryInterval
+	}
+	if conf.clock != nil {
+		s.clock = conf.clock
+	}
+	s.textMessages = conf.TextMessages
+	s.negotiateVersion = conf.NegotiateVersion
+	s.version = 1
+	s.frameInterceptor = conf.FrameInterceptor
+	s.strictProtocol = conf.StrictProtocol
+	s.onProtocolError = conf.OnProtocolError
+	s.writeTimeout = conf.WriteTimeout
+	s.closeFlushTimeout = conf.CloseFlushTimeout
+	s.readTimeout = conf.ReadTimeout
+	if conf.SessionIdleTimeout > 0 {
+		s.sessionIdleTimeout = conf.SessionIdleTimeout
+	}
+	s.onIdleClose = conf.OnIdleClose
+	s.lastReceived = s.clock.Now().UnixNano()
+	if conf.BatchWrites {
+		s.batchWrites = true
+		s.batchFlushInterval = defaultBatchFlushInterval
+		if conf.BatchFlushInterval > 0 {
+			s.batchFlushInterval = conf.BatchFlushInterval
+		}
+		s.batchSize = defaultBatchSize
+		if conf.BatchSize > 0 {
+			s.batchSize = conf.BatchSize
+		}
+	}
+
+	if conf.AckThreshold > 0 {
+		s.ackThreshold = conf.AckThreshold
+		if s.ackThreshold > 1 {
+			s.ackThreshold = 1
+		}
+		s.ackFlushInterval = defaultAckFlushInterval
+		if conf.AckFlushInterval > 0 {
+			s.ackFlushInterval = conf.AckFlushInterval
+		}
+	}
+
+	if conf.EnableCompression {
+		s.conn.EnableWriteCompression(true)
+		if conf.CompressionLevel != 0 {
+			if err := s.conn.SetCompressionLevel(conf.CompressionLevel); err != nil {
+				s.logger.Errorf("ignoring compression level: %v", err)
+			}
+		}
+	}
 
 	s.conn.SetCloseHandler(s.closeHandler)
 	s.conn.SetPongHandler(s.pongHandler)
+	if s.readTimeout > 0 {
+		s.conn.SetPingHandler(s.pingHandler)
+	}
 
-	go s.recvLoop()
-	go s.removeDeadStreams()
-	go s.sendKeepAlives()
+	// a peer that never answers our pings will cause reads to time out; see
+	// pongHandler
+	_ = s.extendReadDeadline()
+
+	if s.negotiateVersion {
+		if err := s.sendVersion(); err != nil {
+			s.logger.Errorf("could not send protocol version: %v", err)
+			s.abort(err)
+		}
+	}
+
+	s.spawn(s.recvLoop)
+	s.spawn(s.removeDeadStreams)
+	if s.keepAliveInterval > 0 {
+		s.spawn(s.sendKeepAlives)
+	}
+	s.spawn(s.writeLoop)
+	if s.streamIdleTimeout > 0 {
+		s.spawn(s.removeIdleStreams)
+	}
+	if s.sessionIdleTimeout > 0 {
+		s.spawn(s.closeWhenIdle)
+	}
+	if s.batchWrites {
+		s.spawn(s.flushBatches)
+	}
+	if s.ackThreshold > 0 {
+		s.spawn(s.flushAcks)
+	}
 	return s
 }
 
+// spawn runs f in a new goroutine, which Shutdown waits for.  It must only be
+// called while the session is starting, or from a goroutine which is itself
+// tracked, so that Shutdown cannot miss it.
+func (s *Session) spawn(f func()) {
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Done()
+		f()
+	}()
+}
+
 // Accept an incoming stream, as specified for the net.Listener interface.
+// The returned connection is always a Stream; use AcceptStream to avoid the
+// type assertion.
 func (s *Session) Accept() (net.Conn, error) {
-	select {
-	case <-s.closed:
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		return nil, s.acceptErr
-	case str := <-s.streamCh:
-		if str == nil {
-			return nil, ErrSessionClosed
+	str, err := s.AcceptContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return str, nil
+}
+
+// AcceptStream is like Accept, but returns a Stream.
+func (s *Session) AcceptStream() (Stream, error) {
+	return s.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but additionally fails with ctx.Err() if the
+// context is done before an incoming stream is available.  The session
+// remains open in that case.  The values of ctx are available from the
+// returned stream's Context.
+func (s *Session) AcceptContext(ctx context.Context) (Stream, error) {
+	if s.isDraining() {
+		return nil, ErrDraining
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.drainingCh:
+			return nil, ErrDraining
+		case <-s.closed:
+			return nil, s.acceptError()
+		case str := <-s.streamCh:
+			if str == nil {
+				return nil, s.acceptError()
+			}
+			err := s.acceptQueued(ctx, str)
+			if err == errStreamRejected {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return str, nil
+		}
+	}
+}
+
+// AcceptN accepts up to n incoming streams at once, for servers which process
+// new streams in batches.  It blocks until at least one stream is available,
+// as for AcceptContext, and then also accepts any further streams which are
+// already waiting, up to n in total, without waiting for more.  If the
+// context is done before any stream is available, it fails with ctx.Err().
+//
+// If the session closes or fails while streams are being accepted, those
+// already accepted are returned along with the error.
+func (s *Session) AcceptN(ctx context.Context, n int) ([]net.Conn, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	str, err := s.AcceptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conns := make([]net.Conn, 1, n)
+	conns[0] = str
+	for len(conns) < n && !s.isDraining() {
+		select {
+		case str := <-s.streamCh:
+			if str == nil {
+				return conns, s.acceptError()
+			}
+			err := s.acceptQueued(ctx, str)
+			if err == errStreamRejected {
+				continue
+			}
+			if err != nil {
+				return conns, err
+			}
+			conns = append(conns, str)
+		default:
+			return conns, nil
 		}
+	}
+	return conns, nil
+}
 
-		// "accept" the stream locally, putting it into a state where it can read and write
-		str.acceptStream(uint32(s.streamBufferSize))
+// acceptQueued accepts a stream taken from streamCh, informing the remote end.
+// If the OnAccept callback rejects the stream, it is reset and
+// errStreamRejected is returned.
+func (s *Session) acceptQueued(ctx context.Context, str *stream) error {
+	// streams may remain in streamCh once it is closed, and were killed with
+	// the session, so must not be accepted
+	if s.IsClosed() {
+		return s.acceptError()
+	}
 
-		// and inform the other side that this stream has been accepted
-		if err := s.send(newAckFrame(str.id, uint32(s.streamBufferSize))); err != nil {
-			s.abort(err)
-			return nil, err
+	window := uint32(s.streamBufferSize)
+	if s.onAccept != nil {
+		w, accept := s.onAccept(str.id)
+		if !accept {
+			s.logger.forStream(str.id).Infof("refusing stream: rejected by OnAccept")
+			s.resetStream(str.id)
+			return errStreamRejected
+		}
+		if w > 0 {
+			if err := str.setInitialWindow(w); err != nil {
+				s.logger.forStream(str.id).Infof("refusing stream: %v", err)
+				s.resetStream(str.id)
+				return errStreamRejected
+			}
+			window = w
 		}
-		return str, nil
 	}
+
+	// "accept" the stream locally, putting it into a state where it can read and write
+	str.setContext(ctx)
+	str.acceptStream(str.initialSendWindow)
+
+	// and inform the other side that this stream has been accepted
+	if err := s.send(s.newAcceptFrame(str.id, window)); err != nil {
+		s.abort(err)
+		return err
+	}
+	atomic.AddUint64(&s.stats.streamsAccepted, 1)
+	return nil
+}
+
+// acceptError returns the error with which Accept fails once the session has
+// closed
+func (s *Session) acceptError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acceptErr
 }
 
-// Open a new stream to the remote end, returning a `net.Conn` as well as a
-// stream ID.  The remote end must call Accept to accept the connection.  If
+// Open a new stream to the remote end, returning a Stream.  The remote end must call Accept to accept the connection.  If
 // this does not occur within the deadline, this function will fail.
 //
 // Opening a connection creates a fresh new stream ID and sends a msgSYN
 // frame containing that ID to the remote side.  The stream is considered
 // accepted when a msgACK frame arrives with the same stream ID.
-func (s *Session) Open() (net.Conn, error) {
-	select {
-	case <-s.closed:
-		return nil, ErrSessionClosed
-	default:
+func (s *Session) Open() (Stream, error) {
+	return s.OpenContext(context.Background())
+}
+
+// OpenWithMeta is like Open, but attaches metadata to the stream, such as
+// routing information, which the accepting end can read with the stream's
+// Metadata method before any data arrives.  The metadata is at most
+// MaxMetadataSize bytes; larger metadata fails with ErrMetadataTooLarge.
+func (s *Session) OpenWithMeta(meta []byte) (Stream, error) {
+	return s.OpenContextWithMeta(context.Background(), meta)
+}
+
+// OpenContext is like Open, but additionally fails with ctx.Err() if the
+// context is done before the remote end accepts the stream.  The session's
+// StreamAcceptDeadline continues to apply.  The values of ctx are available
+// from the returned stream's Context.
+func (s *Session) OpenContext(ctx context.Context) (Stream, error) {
+	return s.OpenContextWithMeta(ctx, nil)
+}
+
+// OpenTimeout is like Open, but waits at most d for the remote end to accept
+// the stream, instead of the session's StreamAcceptDeadline.  If d is not
+// positive, the session's StreamAcceptDeadline is used, which may be disabled.
+func (s *Session) OpenTimeout(d time.Duration) (Stream, error) {
+	if d <= 0 {
+		d = s.streamAcceptDeadline
+	}
+	return s.open(context.Background(), nil, d)
+}
+
+// OpenContextWithMeta combines OpenContext and OpenWithMeta.
+func (s *Session) OpenContextWithMeta(ctx context.Context, meta []byte) (Stream, error) {
+	return s.open(ctx, meta, s.streamAcceptDeadline)
+}
+
+// open implements the Open methods, failing with ErrAcceptTimeout if the
+// remote end does not accept the stream within deadline.  A zero deadline
+// waits indefinitely.
+func (s *Session) open(ctx context.Context, meta []byte, deadline time.Duration) (Stream, error) {
+	if len(meta) > MaxMetadataSize {
+		return nil, ErrMetadataTooLarge
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	// search for an unused stream id; this makes the conservative assumption
-	// that there are far fewer than 2**31 streams open simultaneously, but
-	// allows for example a single long-lived stream with a large number of
-	// transient streams that cause the id space to wrap
-	for {
+	// Close sets s.streams to nil, so this must be checked under the lock
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+
+	if s.draining {
+		s.mu.Unlock()
+		return nil, ErrDraining
+	}
+
+	if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+		s.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+
+	// search for an unused stream id.  The id space wraps, allowing for
+	// example a single long-lived stream with a large number of transient
+	// streams, so ids still in use are skipped.  Our half of the id space has
+	// 2**31 ids; if every one is in use, no stream can be opened.
+	for tries := uint64(0); ; tries++ {
+		if tries == 1<<31 {
+			s.mu.Unlock()
+			return nil, ErrStreamIDExhausted
+		}
 		if _, ok := s.streams[s.nextID]; !ok {
 			break
 		}
 		s.nextID += 2
 	}
+	if !s.reserveBuffer(int64(s.streamBufferSize)) {
+		s.mu.Unlock()
+		return nil, ErrBufferLimit
+	}
 	id := s.nextID
 	s.nextID += 2
 
 	str := newStream(id, s)
+	str.setContext(ctx)
+	if len(meta) > 0 {
+		str.meta = append([]byte(nil), meta...)
+	}
 	s.streams[id] = str
+	s.mu.Unlock()
+	s.streamOpened(id)
 
-	if err := s.send(newSynFrame(id)); err != nil {
+	syn := newSynFrame(id, uint32(s.streamBufferSize), str.meta)
+	if err := s.send(syn); err != nil {
+		s.removeStream(id)
 		return nil, err
 	}
 
-	// unlock mutex and wait
-	s.mu.Unlock()
+	// a nil channel never fires, so without a deadline or retransmission
+	// those cases of the select below are disabled
+	var expired <-chan time.Time
+	if deadline > 0 {
+		timer := s.clock.NewTimer(deadline)
+		defer timer.Stop()
+		expired = timer.C()
+	}
 
-	// locks released by earlier defer call
-	select {
-	case <-str.accepted:
-		s.mu.Lock()
-		return str, nil
-	case <-s.closed:
-		s.mu.Lock()
-		// state of s.nextID doesn't matter here
-		delete(s.streams, id)
-		return nil, ErrSessionClosed
-	case <-time.After(s.streamAcceptDeadline):
-		s.mu.Lock()
-		// nextID can be cyclically reused, and previous instance
-		// may be in use by a different stream
-		delete(s.streams, id)
-		return nil, ErrAcceptTimeout
+	var retransmit <-chan time.Time
+	if s.synRetransmits > 0 {
+		ticker := s.clock.NewTicker(s.synRetransmitInterval)
+		defer ticker.Stop()
+		retransmit = ticker.C()
+	}
+
+	retransmits := 0
+	for {
+		select {
+		case <-retransmit:
+			s.logger.forStream(id).Debugf("retransmitting SYN")
+			if err := s.send(syn); err != nil {
+				s.abandonStream(id)
+				return nil, err
+			}
+			retransmits++
+			if retransmits >= s.synRetransmits {
+				retransmit = nil
+			}
+		case <-str.accepted:
+			if str.isRefused() {
+				s.removeStream(id)
+				return nil, ErrStreamRefused
+			}
+			atomic.AddUint64(&s.stats.streamsOpened, 1)
+			return str, nil
+		case <-s.closed:
+			return nil, ErrSessionClosed
+		case <-expired:
+			// the id is not reused until nextID wraps around, and the search
+			// above skips any ids still in use
+			s.abandonStream(id)
+			return nil, ErrAcceptTimeout
+		case <-ctx.Done():
+			s.abandonStream(id)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// abandonStream removes a stream which is being opened, and sends a msgRST
+// frame so that the remote end does not leak the stream if it accepts it
+// after we have given up.
+func (s *Session) abandonStream(id uint32) {
+	s.removeStream(id)
+	if err := s.send(newRstFrame(id)); err != nil {
+		s.logger.forStream(id).Errorf("could not reset abandoned stream: %v", err)
 	}
 }
 
 // Close closes the current session and underlying websocket connection.
 // All pending Accept calls will fail with ErrSessionClosed, and all existing
 // streams will be killed.
+//
+// Data is delivered at most once.  Data from Write calls which have returned
+// has been written to the websocket connection, or queued by BatchWrites and
+// written here, before the connection is closed.  Data from Write calls still
+// in progress is discarded, unless Config.CloseFlushTimeout allows time for
+// it to be written.  Neither guarantees that the remote application has read
+// the data; for that, use CloseGracefully.
+//
+// With Config.LeaveConnOpen, Close does not close the websocket connection,
+// but waits until the session has stopped using it; see LeaveConnOpen.
 func (s *Session) Close() error {
+	closed, err := s.close()
+	if closed && s.leaveConnOpen {
+		s.waitRecvLoop()
+	}
+	return err
+}
+
+// Shutdown closes the session as described for Close, and then waits until
+// the session's goroutines have exited: those receiving and writing frames,
+// sending keepalives and maintaining streams, and those handling new streams
+// from the remote end.  This allows clean shutdown without leaking
+// goroutines.  Shutdown must not be called from a callback invoked by the
+// session, such as CloseCallback, which may run on one of those goroutines.
+func (s *Session) Shutdown() error {
+	err := s.Close()
+	s.goroutines.Wait()
+	return err
+}
+
+// close closes the session as described for Close, returning true if this
+// call closed it.  Unlike Close, it does not wait for recvLoop to return, so
+// it can be called from within recvLoop.
+func (s *Session) close() (bool, error) {
+	// write any queued data before closing; errors here are not
+	// important, since the connection is closing anyway
+	if !s.IsClosed() {
+		if s.closeFlushTimeout > 0 {
+			_ = s.drainSendQueue(s.closeFlushTimeout)
+		} else if s.batchWrites {
+			s.flushBeforeClose()
+		}
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	select {
 	case <-s.closed:
-		return nil
+		s.mu.Unlock()
+		return false, nil
 	default:
 	}
 
-	// Check if channel has been closed
+	s.acceptErr = ErrSessionClosed
+	if s.closeErr == nil {
+		s.closeErr = ErrSessionClosed
+	}
+	s.abortMu.Lock()
+	close(s.closed)
+	s.abortMu.Unlock()
+	close(s.streamCh)
+
+	// the connection is closed only once s.closed is, so that writes failing
+	// as a result can be recognised; see writeFrame.  It is closed before
+	// streams are killed, since a stream writing batched data holds its lock
+	// while the write blocks on the connection.
 	var err error
 	if s.closeConn {
 		err = s.conn.Close()
+	} else if s.leaveConnOpen {
+		// interrupt recvLoop's pending read, since the connection will not
+		// be closed to do so
+		_ = s.conn.SetReadDeadline(time.Now())
 	}
 
-	// invoke callback
-	defer func() {
-		if s.closeCallback != nil {
-			s.closeCallback()
-		}
-	}()
-
-	for _, v := range s.streams {
+	// streams are killed once the session is marked closed, so that callers
+	// woken by the kill see it closed
+	ids := make([]uint32, 0, len(s.streams))
+	for id, v := range s.streams {
 		v.kill()
+		v.releaseBuffer()
+		ids = append(ids, id)
 	}
+	atomic.AddUint64(&s.stats.streamsClosed, uint64(len(s.streams)))
 	s.streams = nil
-	s.acceptErr = ErrSessionClosed
+	s.mu.Unlock()
+	s.logger.Infof("session closed")
 
-	close(s.closed)
-	close(s.streamCh)
-	return err
-}
+	if s.leaveConnOpen {
+		// wait for any write in progress, and prevent further writes
+		s.sendLock.Lock()
+		s.connReleased = true
+		s.sendLock.Unlock()
+	}
 
-// Addr returns the address of this listener.  This is required for
-// implementing net.Listener, but its return value here is not very useful.
-func (s *Session) Addr() net.Addr {
-	return s.conn.LocalAddr()
+	// invoke callbacks without holding the lock
+	for _, id := range ids {
+		s.streamClosed(id)
+	}
+	if s.closeCallback != nil {
+		s.closeCallback()
+	}
+	return true, err
 }
 
-// IsClosed returns true if the session is closed.
-func (s *Session) IsClosed() bool {
+// flushBeforeClose writes data queued by BatchWrites, waiting at most
+// closeFlushWait.  A write blocked because the remote end has stopped reading
+// holds sendLock indefinitely, so the flush runs in its own goroutine, which
+// exits once the connection is closed.  As in abortAsync, the goroutine is
+// only started if the session has not yet closed, since Close may be called
+// from any goroutine.
+func (s *Session) flushBeforeClose() {
+	done := make(chan struct{})
+	s.abortMu.Lock()
+	if s.IsClosed() {
+		s.abortMu.Unlock()
+		return
+	}
+	s.spawn(func() {
+		_ = s.Flush()
+		close(done)
+	})
+	s.abortMu.Unlock()
+	timer := s.clock.NewTimer(closeFlushWait)
+	defer timer.Stop()
 	select {
-	case <-s.closed:
-		return true
-	default:
+	case <-done:
+	case <-timer.C():
+		s.logger.Errorf("could not write batched data before closing: %v", ErrWriteTimeout)
 	}
-	return false
-}
-
-// pongHandler indicates that a pong message has been seen
-func (s *Session) pongHandler(data string) error {
-	s.mu.Lock()
-	s.pongSeen = true
-	s.mu.Unlock()
-	return nil
 }
 
-// sendKeepAlives sends a ping message every keepAliveInterval, until the
-// connection closes.  If there is an error sending the ping, or no pong is
-// received during the interval, the connection is aborted.
-func (s *Session) sendKeepAlives() {
-	ticker := time.NewTicker(s.keepAliveInterval)
+// waitRecvLoop waits for recvLoop to return after the session has closed with
+// leaveConnOpen.  A control message handler may extend the read deadline
+// after close has interrupted the read, so the interruption is repeated until
+// recvLoop returns.
+func (s *Session) waitRecvLoop() {
 	for {
-		s.sendLock.Lock()
-		err := s.conn.WriteControl(
-			websocket.PingMessage, nil,
-			// use a deadline of half the keepAliveInterval, to ensure the message
-			// is sent in a reasonable amount of time
-			time.Now().Add(s.keepAliveInterval/2))
-		s.sendLock.Unlock()
-		if err != nil {
-			s.abort(err)
-			return
-		}
-
 		select {
-		case <-ticker.C:
-		case <-s.closed:
+		case <-s.recvDone:
 			return
+		case <-time.After(drainCheckDuration):
+			_ = s.conn.SetReadDeadline(time.Now())
 		}
+	}
+}
 
-		// if we have not seen a pong by this time, the connection is
-		// considered failed
-		s.mu.Lock()
-		pongSeen := s.pongSeen
-		s.pongSeen = false
+// StartDraining stops the session from taking on new streams, while existing
+// streams continue to work.  New streams from the remote end are refused with
+// a msgRST frame, as are any streams waiting to be accepted.  Pending and
+// future calls to Accept fail with ErrDraining, as do calls to Open.  This is a
+// softer alternative to Close, for example during a rolling restart.
+func (s *Session) StartDraining() {
+	s.mu.Lock()
+	if s.draining {
 		s.mu.Unlock()
-		if !pongSeen {
-			s.logger.Printf("No pong message seen; aborting session")
-			s.abort(ErrKeepAliveExpired)
+		return
+	}
+	s.draining = true
+	close(s.drainingCh)
+	s.mu.Unlock()
+
+	// refuse streams waiting in the accept queue
+	for {
+		select {
+		case str := <-s.streamCh:
+			if str == nil {
+				// session is already closed
+				return
+			}
+			s.resetStream(str.id)
+		default:
+			return
 		}
 	}
 }
 
-// send transmits a frame over the websocket connection.
-func (s *Session) send(f frame) error {
+// isDraining returns true once StartDraining has been called
+func (s *Session) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// CloseGracefully closes the session once in-flight streams have finished.  It
+// drains the session as with StartDraining, closes all existing
+// streams (sending msgFIN), and waits until the remote end has closed each
+// stream and the local application has read all buffered data.  The session
+// is then closed as with Close.
+//
+// If ctx is done before the streams have drained, the session is closed
+// immediately and ctx.Err() is returned.  If the session closes for any other
+// reason before the streams have drained, for example because the connection
+// was lost, data may have been lost, and the session's Err is returned.
+func (s *Session) CloseGracefully(ctx context.Context) error {
+	s.StartDraining()
+
+	s.mu.Lock()
+	streams := make([]*stream, 0, len(s.streams))
+	for _, str := range s.streams {
+		streams = append(streams, str)
+	}
+	s.mu.Unlock()
+
+	for _, str := range streams {
+		select {
+		case <-str.accepted:
+			_ = str.CloseWrite()
+		default:
+			// the remote end has not accepted this stream yet, so it
+			// cannot be closed gracefully
+			s.resetStream(str.id)
+		}
+	}
+
+	ticker := s.clock.NewTicker(drainCheckDuration)
+	defer ticker.Stop()
+	for !s.streamsDrained() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+			return ctx.Err()
+		case <-s.closed:
+			// streamsDrained is vacuously true once the session has
+			// closed, so check the streams themselves
+			for _, str := range streams {
+				if !str.isDrained() {
+					return s.Err()
+				}
+			}
+			return nil
+		case <-ticker.C():
+		}
+	}
+	return s.Close()
+}
+
+// streamsDrained returns true if every stream is removable
+func (s *Session) streamsDrained() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, str := range s.streams {
+		if !str.isRemovable() {
+			return false
+		}
+	}
+	return true
+}
+
+// CloseError returns the websocket close code and reason with which the remote
+// end closed the connection, such as websocket.CloseNormalClosure or
+// websocket.CloseGoingAway.  If the connection was lost without a close frame,
+// the code is websocket.CloseAbnormalClosure.  If the remote end has not closed
+// the connection, the code is 0.
+func (s *Session) CloseError() (code int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeCode, s.closeReason
+}
+
+// SetCompressionLevel sets the compression level used for subsequent frames,
+// if compression is enabled; see compress/flate for valid levels.
+func (s *Session) SetCompressionLevel(level int) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if s.connReleased {
+		return ErrSessionClosed
+	}
+	return s.conn.SetCompressionLevel(level)
+}
+
+// Addr returns the address of this listener.  This is required for
+// implementing net.Listener, but its return value here is not very useful.
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Subprotocol returns the websocket subprotocol negotiated for the session's
+// connection, or an empty string if none was; see Config.Subprotocols.
+func (s *Session) Subprotocol() string {
+	return s.conn.Subprotocol()
+}
+
+// IsClosed returns true if the session is closed.
+func (s *Session) IsClosed() bool {
 	select {
 	case <-s.closed:
-		return ErrSessionClosed
+		return true
 	default:
 	}
+	return false
+}
+
+// Done returns a channel which is closed when the session closes, for use in
+// select statements in the same way as context.Context.Done.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns nil while the session is open.  Once it has closed, Err returns
+// the error which caused it to close, or ErrSessionClosed if it was closed
+// normally.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.IsClosed() {
+		return nil
+	}
+	return s.closeErr
+}
+
+// StreamIDs returns the IDs of the streams currently tracked by the session,
+// in ascending order.  Like NumStreams, this includes streams not yet accepted,
+// and is empty once the session is closed.
+func (s *Session) StreamIDs() []uint32 {
+	s.mu.Lock()
+	ids := make([]uint32, 0, len(s.streams))
+	for id := range s.streams {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// NumStreams returns the number of streams currently tracked by the session,
+// including streams not yet accepted.  This is 0 once the session is closed.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// extendReadDeadline sets the connection's read deadline, after receiving
+// something from the remote end.  With a ReadTimeout, that is the deadline for
+// receiving anything further; otherwise, the deadline is two keepalive
+// intervals, and is only extended by pongs.  With neither, there is no
+// deadline.  This must only be called before recvLoop starts, or from within
+// it (including control message handlers).
+func (s *Session) extendReadDeadline() error {
+	if s.readTimeout > 0 {
+		return s.conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+	}
+	if s.keepAliveInterval == 0 {
+		return s.conn.SetReadDeadline(time.Time{})
+	}
+	return s.conn.SetReadDeadline(time.Now().Add(2 * s.keepAliveInterval))
+}
+
+// writeControl writes a control message, holding sendLock so that it is
+// serialized with data frames and other control messages.
+func (s *Session) writeControl(messageType int, data []byte, deadline time.Time) error {
 	s.sendLock.Lock()
 	defer s.sendLock.Unlock()
-	err := s.conn.WriteMessage(websocket.BinaryMessage, f.serialize())
+	if s.connReleased {
+		return ErrSessionClosed
+	}
+	return s.conn.WriteControl(messageType, data, deadline)
+}
+
+// pingHandler handles a ping from the remote end when a ReadTimeout is set,
+// extending the read deadline and replying as the default handler does.
+//
+// Unlike other writes, the pong does not wait for sendLock, which gorilla
+// allows for WriteControl.  Blocking recvLoop behind a data write could
+// deadlock, if the remote end's writes are in turn blocked because this end
+// has stopped reading.
+func (s *Session) pingHandler(data string) error {
+	if err := s.extendReadDeadline(); err != nil {
+		return err
+	}
+	err := s.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	if err == websocket.ErrCloseSent {
+		return nil
+	} else if e, ok := err.(net.Error); ok && e.Temporary() {
+		return nil
+	}
 	return err
 }
 
-// called when websocket connection is closed
+// pongHandler indicates that a pong message has been seen, and extends the
+// read deadline of the connection.  This is called from within recvLoop, so
+// it is safe to manipulate the read deadline here.
+func (s *Session) pongHandler(data string) error {
+	s.mu.Lock()
+	s.pongSeen = true
+	s.mu.Unlock()
+
+	// keepalive pings carry the time they were sent, and pings from Ping
+	// additionally carry a sequence number; pongs with any other payload are
+	// not used for measurement
+	payload := []byte(data)
+	if len(payload) == 16 {
+		seq := binary.LittleEndian.Uint64(payload[8:])
+		s.mu.Lock()
+		if ch, ok := s.pings[seq]; ok {
+			delete(s.pings, seq)
+			close(ch)
+		}
+		s.mu.Unlock()
+		payload = payload[:8]
+	}
+	if len(payload) == 8 {
+		sent := int64(binary.LittleEndian.Uint64(payload))
+		if sample := s.clock.Now().UnixNano() - sent; sample >= 0 {
+			s.updateRTT(sample)
+		}
+	}
+	return s.extendReadDeadline()
+}
+
+// updateRTT adds an RTT sample to the exponentially-weighted moving average,
+// giving the new sample a weight of 1/8.  This is only called from
+// pongHandler, so no compare-and-swap is required.
+func (s *Session) updateRTT(sample int64) {
+	rtt := atomic.LoadInt64(&s.rtt)
+	if rtt == 0 {
+		rtt = sample
+	} else {
+		rtt += (sample - rtt) / 8
+	}
+	atomic.StoreInt64(&s.rtt, rtt)
+}
+
+// RTT returns a smoothed estimate of the round-trip time to the remote end,
+// measured using keepalive pings.  It returns 0 until the first pong has
+// been received.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// Ping sends a websocket ping to the remote end and waits for the matching
+// pong, returning the round-trip time.  It fails if the session closes, or
+// with ctx.Err() if the context is done first.  Concurrent calls are
+// distinguished by the ping payload, and do not interfere with keepalives.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return 0, ErrSessionClosed
+	}
+	s.pingSeq++
+	seq := s.pingSeq
+	pong := make(chan struct{})
+	s.pings[seq] = pong
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, seq)
+		s.mu.Unlock()
+	}()
+
+	start := s.clock.Now()
+	ping := make([]byte, 16)
+	binary.LittleEndian.PutUint64(ping, uint64(start.UnixNano()))
+	binary.LittleEndian.PutUint64(ping[8:], seq)
+
+	deadline := time.Now().Add(pingWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.writeControl(websocket.PingMessage, ping, deadline); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-pong:
+		return s.clock.Now().Sub(start), nil
+	case <-s.closed:
+		return 0, ErrSessionClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// nextKeepAlive returns the time until the next keepalive: keepAliveInterval,
+// varied randomly by up to keepAliveJitter in either direction
+func (s *Session) nextKeepAlive() time.Duration {
+	if s.keepAliveJitter == 0 {
+		return s.keepAliveInterval
+	}
+	f := 1 + s.keepAliveJitter*(2*rand.Float64()-1)
+	return time.Duration(float64(s.keepAliveInterval) * f)
+}
+
+// sendKeepAlives sends a ping message every keepAliveInterval, until the
+// connection closes.  If there is an error sending the ping, or no pong is
+// received for two consecutive intervals, the connection is aborted.
+func (s *Session) sendKeepAlives() {
+	missed := 0
+	for {
+		// the ping carries its send time, which the remote end returns in
+		// the pong, for measuring RTT
+		ping := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ping, uint64(s.clock.Now().UnixNano()))
+
+		// use a deadline of half the keepAliveInterval, to ensure the message
+		// is sent in a reasonable amount of time
+		err := s.writeControl(websocket.PingMessage, ping, time.Now().Add(s.keepAliveInterval/2))
+		if err != nil {
+			s.abort(err)
+			return
+		}
+
+		timer := s.clock.NewTimer(s.nextKeepAlive())
+		select {
+		case <-timer.C():
+		case <-s.closed:
+			timer.Stop()
+			return
+		}
+
+		// if we have not seen a pong for two intervals, the connection is
+		// considered failed
+		s.mu.Lock()
+		pongSeen := s.pongSeen
+		s.pongSeen = false
+		s.mu.Unlock()
+		if pongSeen {
+			missed = 0
+			continue
+		}
+		missed++
+		if missed >= 2 {
+			s.logger.Errorf("No pong message seen; aborting session")
+			s.abort(ErrKeepAliveExpired)
+			return
+		}
+	}
+}
+
+// send transmits a frame over the websocket connection, ahead of any queued
+// data.  Any error writing to the connection is returned to the caller.
+func (s *Session) send(f frame) error {
+	return s.sendAt(f, controlPriority)
+}
+
+// setWriteDeadline applies the WriteTimeout, if any, to the next write to the
+// websocket connection, aborting the session if that fails.  The caller must
+// hold sendLock.
+func (s *Session) setWriteDeadline() error {
+	if s.writeTimeout == 0 {
+		return nil
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+		s.abortAsync(err)
+		return err
+	}
+	return nil
+}
+
+// writeMessage writes a websocket message containing data, as a binary
+// message or, with Config.TextMessages, base64-encoded in a text message.  The
+// caller must hold sendLock.
+func (s *Session) writeMessage(data []byte) error {
+	if s.textMessages {
+		return s.conn.WriteMessage(websocket.TextMessage, []byte(base64.StdEncoding.EncodeToString(data)))
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// writeFrame writes a single frame to the websocket connection, aborting the
+// session if that fails.  The caller must hold sendLock.
+func (s *Session) writeFrame(f frame) error {
+	if s.connReleased {
+		return ErrSessionClosed
+	}
+	if err := s.intercept(Outbound, f); err != nil {
+		s.logger.forStream(f.id).Infof("frame rejected by interceptor: %v", err)
+		return err
+	}
+
+	if err := s.setWriteDeadline(); err != nil {
+		return err
+	}
+
+	err := s.writeMessage(f.serialize())
+	if err != nil && s.IsClosed() {
+		// Close closed the connection during the write, so the error is
+		// expected, and the caller should see why
+		return ErrSessionClosed
+	}
+	if err != nil {
+		// note that this does not log the frame itself, as it may contain
+		// arbitrary binary data
+		s.logger.forStream(f.id).Errorf("error writing frame: %v", err)
+		// identify the frame in the error, which may be returned far from
+		// the write, for example from Session.Err
+		err = fmt.Errorf("wsmux: writing %v frame for stream %d: %w", FrameType(f.msg), f.id, err)
+		// the connection is unusable, so tear down the session rather than
+		// letting later sends fail one by one.  This happens asynchronously,
+		// since the caller holds sendLock, which Close requires.
+		s.abortAsync(err)
+		return err
+	}
+	countFrame(&s.stats.framesSent, &s.stats.bytesSent, f)
+	return nil
+}
+
+// called when websocket connection is closed by the remote end
 func (s *Session) closeHandler(code int, text string) error {
-	s.logger.Printf("wsmux connection closed: code %d : %s", code, text)
+	s.logger.Infof("wsmux connection closed: code %d : %s", code, text)
 	s.mu.Lock()
 	// indicate that `s.Close()` need not close the websocket connection,
 	// as it is already closed.
 	s.closeConn = false
+	s.closeCode, s.closeReason = code, text
+	if code == CloseUnsupportedVersion && !s.IsClosed() {
+		s.closeErr = ErrUnsupportedVersion
+	}
 	s.mu.Unlock()
-	return s.Close()
+
+	// only invoke the remote close callback if the session was not already
+	// closed locally
+	remote := !s.IsClosed()
+	_, err := s.close()
+	if remote && s.remoteCloseCallback != nil {
+		s.remoteCloseCallback()
+	}
+	return err
 }
 
 // recvLoop sits in a groutine and receives frames over the websocket
 // connection, calling various `handle` methods as appropriate.
+//
+// Errors reading from the websocket connection are unrecoverable, and close
+// the session.  Messages and frames which violate the protocol are discarded,
+// resetting the affected stream where there is one, and reading continues,
+// unless Config.StrictProtocol is set; see protocolViolation.
 func (s *Session) recvLoop() {
+	defer close(s.recvDone)
+
+	// reused for each message, to avoid an allocation per frame
+	var lr io.LimitedReader
+	// only the first message may advertise the remote end's protocol version
+	first := true
 	for {
 		select {
 		case <-s.closed:
@@ -333,32 +1407,128 @@ func (s *Session) recvLoop() {
 		default:
 		}
 
-		t, msg, err := s.conn.ReadMessage()
+		t, r, err := s.conn.NextReader()
 		if err != nil {
-			s.logger.Printf("error while reading from WS: %v", err)
+			// record abnormal closures, which do not invoke closeHandler
+			if ce, ok := err.(*websocket.CloseError); ok {
+				s.mu.Lock()
+				if s.closeCode == 0 {
+					s.closeCode, s.closeReason = ce.Code, ce.Text
+				}
+				s.mu.Unlock()
+			}
+			s.logger.Errorf("error while reading from WS: %v", err)
 			s.abort(err)
-			break
+			return
+		}
+		if s.readTimeout > 0 {
+			if err := s.extendReadDeadline(); err != nil {
+				s.abort(err)
+				return
+			}
 		}
-		if t != websocket.BinaryMessage {
-			s.logger.Print("did not receive binary message")
+		if t != websocket.BinaryMessage && !(t == websocket.TextMessage && s.textMessages) {
+			s.logger.Errorf("discarding websocket message of type %d; only binary messages are expected", t)
+			atomic.AddUint64(&s.stats.messagesDropped, 1)
+			s.protocolViolation(ErrUnexpectedMessage)
 			continue
 		}
 
-		fr, err := deserializeFrame(msg)
-		if err != nil {
-			s.logger.Print(err)
+		// the message is read into a pooled buffer, which is safe because
+		// handleMessage does not retain the frame payload.  At most one byte
+		// more than the maximum message size is read, so that oversized
+		// messages can be detected without buffering them; NextReader
+		// discards the remainder.
+		limit := int64(HEADER_SIZE + s.maxFrameSize)
+		if t == websocket.TextMessage {
+			limit = int64(base64.StdEncoding.EncodedLen(int(limit)))
+		}
+		buf := messageBufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		lr.R, lr.N = r, limit+1
+		if _, err := buf.ReadFrom(&lr); err != nil {
+			messageBufferPool.Put(buf)
+			s.logger.Errorf("error while reading from WS: %v", err)
+			s.abort(err)
+			return
+		}
+		if int64(buf.Len()) > limit {
+			s.discardOversized(buf.Bytes(), t == websocket.TextMessage)
+			messageBufferPool.Put(buf)
 			continue
 		}
-
-		if fr.msg == msgSYN {
-			go s.handleSyn(fr.id)
+		msg := buf.Bytes()
+		if t == websocket.TextMessage {
+			msg, err = base64.StdEncoding.DecodeString(buf.String())
+			if err != nil {
+				messageBufferPool.Put(buf)
+				s.logger.Errorf("discarding text message: %v", err)
+				atomic.AddUint64(&s.stats.messagesDropped, 1)
+				s.protocolViolation(ErrMalformedFrame)
+				continue
+			}
+		}
+		if first && isVersionMessage(msg) {
+			s.handleVersion(msg[HEADER_SIZE:])
 		} else {
-			s.mu.Lock()
-			str := s.streams[fr.id]
-			s.mu.Unlock()
+			s.handleMessage(msg)
+		}
+		first = false
+		messageBufferPool.Put(buf)
+	}
+}
+
+// handleMessage parses a single websocket message and dispatches the frame it
+// contains.  The message is not used after this method returns.
+func (s *Session) handleMessage(msg []byte) {
+	if len(msg) >= HEADER_SIZE && header(msg[:HEADER_SIZE]).msg() == msgBAT {
+		s.handleBatch(msg[HEADER_SIZE:])
+		return
+	}
+
+	// a frame which cannot be parsed is discarded, rather than being
+	// dispatched based on a partial header
+	fr, err := s.parseFrame(msg)
+	if err != nil {
+		s.logger.Errorf("discarding frame: %v", err)
+		s.protocolViolation(err)
+		return
+	}
+	if err := s.intercept(Inbound, fr); err != nil {
+		s.logger.forStream(fr.id).Infof("dropping frame: %v", err)
+		return
+	}
+	countFrame(&s.stats.framesReceived, &s.stats.bytesReceived, fr)
+	atomic.StoreInt64(&s.lastReceived, s.clock.Now().UnixNano())
+
+	switch fr.msg {
+	case msgSYN:
+		// handleSyn runs asynchronously, so it needs its own copy of the payload
+		syn := fr
+		syn.payload = append([]byte(nil), fr.payload...)
+		s.spawn(func() { s.handleSyn(&syn) })
+	case msgRST:
+		s.handleRst(fr.id)
+	default:
+		s.mu.Lock()
+		str := s.streams[fr.id]
+		s.mu.Unlock()
+
+		if str != nil {
+			// stream buffers copy DAT payloads, so the frame can be
+			// handled directly
+			str.handleFrame(fr)
+			return
+		}
 
-			if str != nil {
-				str.handleFrame(*fr)
+		// the stream may have been reset or abandoned by this end, or removed
+		// after closing.  Data for it will never be read, so the remote end is
+		// told to reset the stream; other frames are not answered, as the
+		// remote end may legitimately send them after a stream is removed.
+		s.logger.forStream(fr.id).Debugf("discarding frame of type %d for unknown stream", fr.msg)
+		if fr.msg == msgDAT {
+			if err := s.send(newRstFrame(fr.id)); err != nil {
+				s.logger.forStream(fr.id).Errorf("could not reset unknown stream: %v", err)
 			}
 		}
 	}
@@ -366,27 +1536,265 @@ func (s *Session) recvLoop() {
 
 // handleSyn creates a new stream and adds it to s.streamCh so that it can be returned
 // from Accept.  As part of the two-way stream setup handshake, it responds with a
-// msgACK frame indicating that the request has been received.
-func (s *Session) handleSyn(id uint32) {
+// msgACK frame indicating that the request has been received.  If the session
+// already has MaxStreams streams, or too many streams are waiting to be
+// accepted (after any retries configured with Config.AcceptQueueRetries), or
+// the session is draining, the stream is refused with a msgRST frame.  SYN
+// frames with an ID from the local end's ID space are likewise refused.
+func (s *Session) handleSyn(fr *frame) {
+	id := fr.id
 	s.mu.Lock()
 
-	// check if stream exists
-	_, ok := s.streams[id]
+	// a SYN may arrive while the session is closing; once it has closed,
+	// s.streams is nil and s.streamCh is closed, so neither can be used
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return
+	}
+
+	// the remote end must use IDs of the opposite parity to our own; a SYN in
+	// our ID space is a protocol error.  Reset the stream on the remote end
+	// only, leaving any local stream with this ID untouched.
+	if id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		s.logger.forStream(id).Errorf("refusing stream: %v", ErrInvalidStreamID)
+		if err := s.send(newRstFrame(id)); err != nil {
+			s.logger.forStream(id).Errorf("could not reset stream: %v", err)
+		}
+		s.streamProtocolViolation(id, ErrInvalidStreamID)
+		return
+	}
+
+	// check if stream exists.  A msgSYN frame identical to that which opened
+	// the stream is a retransmission (see Config.SynRetransmits), and is
+	// ignored.  Otherwise, the two sides disagree about the state of this
+	// stream id, so reset it.
+	existing, ok := s.streams[id]
+	if ok && existing.isRetransmittedSyn(fr.payload) {
+		s.mu.Unlock()
+		s.logger.forStream(id).Debugf("ignoring retransmitted SYN frame")
+		return
+	}
 	if ok {
-		s.logger.Printf("duplicate SYN frame for stream: %d", id)
 		s.mu.Unlock()
+		s.logger.forStream(id).Errorf("duplicate SYN frame")
+		s.resetStream(id)
+		s.streamProtocolViolation(id, ErrDuplicateStream)
+		return
+	}
+
+	if s.draining {
+		s.mu.Unlock()
+		s.logger.forStream(id).Infof("refusing stream: session is draining")
+		s.resetStream(id)
+		return
+	}
+
+	if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+		s.mu.Unlock()
+		s.logger.forStream(id).Infof("refusing stream: %v", ErrTooManyStreams)
+		s.resetStream(id)
+		return
+	}
+
+	if len(fr.payload) > 4+MaxMetadataSize {
+		s.mu.Unlock()
+		s.logger.forStream(id).Errorf("refusing stream: %v", ErrMetadataTooLarge)
+		s.resetStream(id)
+		s.streamProtocolViolation(id, ErrMetadataTooLarge)
+		return
+	}
+
+	if !s.reserveBuffer(int64(s.streamBufferSize)) {
+		s.mu.Unlock()
+		s.logger.forStream(id).Infof("refusing stream: %v", ErrBufferLimit)
+		s.resetStream(id)
 		return
 	}
 
 	str := newStream(id, s)
+	str.initialSendWindow = uint32(s.initialSendWindow)
+	if len(fr.payload) >= 4 {
+		str.initialSendWindow = binary.LittleEndian.Uint32(fr.payload)
+	}
+	if len(fr.payload) > 4 {
+		// the payload aliases the receive buffer, so it must be copied
+		str.meta = append([]byte(nil), fr.payload[4:]...)
+	}
 	s.streams[id] = str
 
-	defer s.mu.Unlock()
-	select {
-	case s.streamCh <- str:
-	default:
-		str.Close()
-		s.abort(ErrTooManySyns)
+	err := s.queueStream(str)
+	s.mu.Unlock()
+	switch err {
+	case nil:
+		s.streamOpened(id)
+	case ErrTooManySyns:
+		// the accept queue is full; refuse the stream so that both sides
+		// agree that it does not exist
+		s.logger.forStream(id).Errorf("refusing stream: %v", ErrTooManySyns)
+		s.resetStream(id)
+	}
+}
+
+// queueStream adds a new remotely-opened stream to the accept queue.  If the
+// queue is full, it retries up to acceptRetries times, releasing s.mu while
+// waiting between attempts.  It returns ErrTooManySyns if the queue remains
+// full, or another error if the session closes or the stream is reset while
+// waiting.  The caller must hold s.mu, which is held again on return.
+func (s *Session) queueStream(str *stream) error {
+	for attempt := 0; ; attempt++ {
+		select {
+		case s.streamCh <- str:
+			return nil
+		default:
+		}
+		if attempt >= s.acceptRetries {
+			return ErrTooManySyns
+		}
+
+		s.mu.Unlock()
+		timer := s.clock.NewTimer(s.acceptRetryInterval)
+		select {
+		case <-timer.C():
+		case <-s.closed:
+		}
+		timer.Stop()
+		s.mu.Lock()
+
+		// s.streamCh is closed along with the session, so it must not be used
+		// after that
+		if s.IsClosed() {
+			return ErrSessionClosed
+		}
+		if s.streams[str.id] != str {
+			return ErrStreamClosed
+		}
+	}
+}
+
+// handleRst handles a msgRST frame from the remote end, immediately removing
+// the stream from the session.
+func (s *Session) handleRst(id uint32) {
+	s.mu.Lock()
+	str := s.streams[id]
+	delete(s.streams, id)
+	s.mu.Unlock()
+
+	if str != nil {
+		str.reset()
+		str.releaseBuffer()
+		atomic.AddUint64(&s.stats.streamsClosed, 1)
+		s.streamClosed(id)
+	}
+}
+
+// protocolViolation is called after discarding a message or frame which
+// violates the protocol, where the violation cannot be attributed to a
+// stream; see reportViolation.
+func (s *Session) protocolViolation(kind error) {
+	s.reportViolation(&ProtocolError{Kind: kind})
+}
+
+// streamProtocolViolation is called after discarding a frame which violates
+// the protocol, and resetting the stream it belongs to; see reportViolation.
+func (s *Session) streamProtocolViolation(id uint32, kind error) {
+	s.reportViolation(&ProtocolError{Kind: kind, StreamID: id, HasStreamID: true})
+}
+
+// reportViolation passes a protocol violation to the OnProtocolError
+// callback, if any.  Such an error affects at most one stream, so the session
+// continues, unless Config.StrictProtocol is set, in which case it is closed
+// with that error.
+func (s *Session) reportViolation(err *ProtocolError) {
+	if s.onProtocolError != nil {
+		s.onProtocolError(err)
+	}
+	if s.strictProtocol {
+		s.abort(err)
+	}
+}
+
+// discardOversized handles a message larger than the maximum frame size,
+// given its first bytes, by resetting the stream it belongs to, and reports
+// the protocol violation.
+func (s *Session) discardOversized(msg []byte, text bool) {
+	atomic.AddUint64(&s.stats.messagesDropped, 1)
+	if text {
+		// the header is encoded in the first 8 bytes of base64
+		hdr := make([]byte, 6)
+		if _, err := base64.StdEncoding.Decode(hdr, msg[:8]); err != nil {
+			s.logger.Errorf("discarding oversized text message: %v", err)
+			s.protocolViolation(ErrFrameTooLarge)
+			return
+		}
+		msg = hdr
+	}
+	h := header(msg[:HEADER_SIZE])
+	if h.msg() != msgDAT {
+		s.logger.Errorf("discarding oversized frame of type %d", h.msg())
+		s.protocolViolation(ErrFrameTooLarge)
+		return
+	}
+	s.logger.forStream(h.id()).Errorf("frame exceeds maximum size of %d bytes; resetting stream", s.maxFrameSize)
+	s.resetStream(h.id())
+	s.streamProtocolViolation(h.id(), ErrFrameTooLarge)
+}
+
+// resetStream abruptly terminates the stream with the given id, if it exists
+// locally, and sends a msgRST frame so that the remote end does the same.
+func (s *Session) resetStream(id uint32) {
+	s.handleRst(id)
+	if err := s.send(newRstFrame(id)); err != nil {
+		s.logger.forStream(id).Errorf("could not reset stream: %v", err)
+	}
+}
+
+// removeStream removes the stream with the given id from the session
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	str, ok := s.streams[id]
+	delete(s.streams, id)
+	s.mu.Unlock()
+	if ok {
+		str.releaseBuffer()
+		s.streamClosed(id)
+	}
+}
+
+// reserveBuffer reserves n bytes of receive window from the session's
+// MaxTotalBuffer, returning false if that would exceed the limit.
+func (s *Session) reserveBuffer(n int64) bool {
+	if s.maxTotalBuffer == 0 {
+		atomic.AddInt64(&s.reservedBuffer, n)
+		return true
+	}
+	for {
+		cur := atomic.LoadInt64(&s.reservedBuffer)
+		if cur+n > s.maxTotalBuffer {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.reservedBuffer, cur, cur+n) {
+			return true
+		}
+	}
+}
+
+// releaseBuffer returns receive window reserved with reserveBuffer
+func (s *Session) releaseBuffer(n int64) {
+	atomic.AddInt64(&s.reservedBuffer, -n)
+}
+
+// streamOpened invokes the OnStreamOpen callback, if any
+func (s *Session) streamOpened(id uint32) {
+	if s.onStreamOpen != nil {
+		s.onStreamOpen(id)
+	}
+}
+
+// streamClosed invokes the OnStreamClose callback, if any
+func (s *Session) streamClosed(id uint32) {
+	if s.onStreamClose != nil {
+		s.onStreamClose(id)
 	}
 }
 
@@ -397,10 +1805,27 @@ func (s *Session) abort(e error) {
 	}
 
 	s.mu.Lock()
-	s.logger.Printf("session aborting: %v", e)
+	s.logger.Errorf("session aborting: %v", e)
 	s.acceptErr = e
+	if !s.IsClosed() {
+		s.closeErr = e
+	}
 	s.mu.Unlock()
-	s.Close()
+	_, _ = s.close()
+}
+
+// abortAsync aborts the session in a new goroutine, for callers which hold
+// sendLock, which closing the session may require.  Unlike spawn, it may be
+// called from any goroutine: the goroutine is only started, and tracked for
+// Shutdown, if the session has not yet closed, in which case Shutdown cannot
+// yet be waiting for the session's goroutines.
+func (s *Session) abortAsync(err error) {
+	s.abortMu.Lock()
+	defer s.abortMu.Unlock()
+	if s.IsClosed() {
+		return
+	}
+	s.spawn(func() { s.abort(err) })
 }
 
 // loops over streams and removes any streams that are dead
@@ -411,16 +1836,112 @@ func (s *Session) removeDeadStreams() {
 		select {
 		case <-s.closed:
 			return
-		case <-time.After(deadCheckDuration):
+		case <-s.clock.After(deadCheckDuration):
 		}
 
+		var removed []uint32
 		s.mu.Lock()
 		for _, str := range s.streams {
 
 			if str.isRemovable() {
 				delete(s.streams, str.id)
+				str.releaseBuffer()
+				atomic.AddUint64(&s.stats.streamsClosed, 1)
+				removed = append(removed, str.id)
 			}
 		}
 		s.mu.Unlock()
+
+		for _, id := range removed {
+			s.streamClosed(id)
+		}
+	}
+}
+
+// periodically resets streams which have been idle for longer than
+// streamIdleTimeout
+func (s *Session) removeIdleStreams() {
+	ticker := s.clock.NewTicker(s.streamIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C():
+		}
+
+		cutoff := s.clock.Now().Add(-s.streamIdleTimeout)
+		var idle []uint32
+		s.mu.Lock()
+		for id, str := range s.streams {
+			if str.isIdle(cutoff) {
+				idle = append(idle, id)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, id := range idle {
+			s.logger.forStream(id).Infof("resetting idle stream")
+			s.resetStream(id)
+		}
+	}
+}
+
+// periodically sends the credit withheld by streams coalescing ACKs; see
+// Config.AckThreshold
+func (s *Session) flushAcks() {
+	ticker := s.clock.NewTicker(s.ackFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C():
+		}
+
+		s.mu.Lock()
+		streams := make([]*stream, 0, len(s.streams))
+		for _, str := range s.streams {
+			streams = append(streams, str)
+		}
+		s.mu.Unlock()
+
+		for _, str := range streams {
+			if err := str.flushAck(); err != nil {
+				s.logger.forStream(str.id).Debugf("could not flush ACK: %v", err)
+			}
+		}
+	}
+}
+
+// closes the session if it has no streams and no frames have been received
+// for sessionIdleTimeout
+func (s *Session) closeWhenIdle() {
+	ticker := s.clock.NewTicker(s.sessionIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C():
+		}
+
+		last := time.Unix(0, atomic.LoadInt64(&s.lastReceived))
+		if s.clock.Now().Sub(last) < s.sessionIdleTimeout {
+			continue
+		}
+		s.mu.Lock()
+		active := len(s.streams)
+		s.mu.Unlock()
+		if active > 0 {
+			continue
+		}
+
+		s.logger.Infof("closing idle session")
+		_ = s.Close()
+		if s.onIdleClose != nil {
+			s.onIdleClose()
+		}
+		return
 	}
 }
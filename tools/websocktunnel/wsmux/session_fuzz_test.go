@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+package wsmux
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+// FuzzHandleMessage feeds arbitrary websocket messages to a session's receive
+// path, which parses frame headers and batches and dispatches the frames to
+// streams.  Invalid messages must be reported as protocol violations of a
+// known kind, and must not cause a panic.
+func FuzzHandleMessage(f *testing.F) {
+	f.Add(newDataFrame(1, []byte("data")).serialize())
+	f.Add(newDataFrame(2, nil).serialize())
+	f.Add(newSynFrame(2, 1024, []byte("meta")).serialize())
+	f.Add(newAckFrame(2, 1024).serialize())
+	f.Add(newFinFrame(2).serialize())
+	f.Add(newRstFrame(2).serialize())
+	f.Add([]byte{msgBAT, 0, 0, 0, 0, 9, 0, 0, 0, msgACK, 2, 0, 0, 0, 0, 4, 0, 0})
+	f.Add([]byte{msgSYN})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		// reply to frames from the session under test, but never open or
+		// accept streams
+		_ = Server(conn, Config{})
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	kinds := []error{ErrMalformedHeader, ErrMalformedFrame, ErrFrameTooLarge, ErrDuplicateStream, ErrWindowExceeded, ErrInvalidStreamID, ErrMetadataTooLarge, ErrUnexpectedFrame}
+	violations := make(chan error, 1000)
+	session := Client(conn, Config{
+		Log:             genLogger(),
+		OnProtocolError: func(err error) { violations <- err },
+	})
+	defer session.Close()
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		session.handleMessage(msg)
+		for {
+			select {
+			case err := <-violations:
+				var pe *ProtocolError
+				if !errors.As(err, &pe) {
+					t.Fatalf("violation %v is not a *ProtocolError", err)
+				}
+				known := false
+				for _, kind := range kinds {
+					known = known || pe.Kind == kind
+				}
+				if !known {
+					t.Fatalf("violation of unknown kind: %v", err)
+				}
+			default:
+				if session.IsClosed() {
+					t.Fatalf("session closed: %v", session.Err())
+				}
+				return
+			}
+		}
+	})
+}
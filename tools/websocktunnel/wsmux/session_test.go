@@ -2,9 +2,24 @@ package wsmux
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"net/http"
 	"net/http/httptest"
 
 	"github.com/gorilla/websocket"
@@ -30,7 +45,7 @@ func TestEcho(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = stream.Close()
+	err = stream.CloseWrite()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,7 +81,7 @@ func TestEchoLarge(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = stream.Close()
+	err = stream.CloseWrite()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,3 +95,2554 @@ func TestEchoLarge(t *testing.T) {
 		t.Fatal("message not consistent")
 	}
 }
+
+func TestKeepAlive(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{KeepAliveInterval: 50 * time.Millisecond, Log: genLogger()})
+	defer session.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	if session.IsClosed() {
+		t.Fatal("session should still be open")
+	}
+}
+
+func TestKeepAliveExpires(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, silentConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{KeepAliveInterval: 100 * time.Millisecond, Log: genLogger()})
+
+	select {
+	case <-session.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed when pongs stopped")
+	}
+}
+
+func TestKeepAliveJitter(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	const interval = time.Second
+	for _, tc := range []struct {
+		jitter, want float64
+	}{
+		{0, 0.1},
+		{0.25, 0.25},
+		{2, 0.5},
+		{-1, 0},
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := Client(conn, Config{KeepAliveInterval: interval, KeepAliveJitter: tc.jitter, Log: genLogger()})
+		min := time.Duration(float64(interval) * (1 - tc.want))
+		max := time.Duration(float64(interval) * (1 + tc.want))
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			d := session.nextKeepAlive()
+			if d < min || d > max {
+				t.Fatalf("jitter %v: interval %v outside [%v, %v]", tc.jitter, d, min, max)
+			}
+			seen[d] = true
+		}
+		if tc.want == 0 && len(seen) != 1 {
+			t.Fatalf("jitter %v: expected a fixed interval, got %d distinct intervals", tc.jitter, len(seen))
+		}
+		if tc.want != 0 && len(seen) < 100 {
+			t.Fatalf("jitter %v: expected varied intervals, got %d distinct intervals", tc.jitter, len(seen))
+		}
+		_ = session.Close()
+	}
+}
+
+func TestOpenContextCancelled(t *testing.T) {
+	// the server never accepts the stream
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = session.OpenContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if len(session.streams) != 0 {
+		t.Fatal("cancelled stream was not removed")
+	}
+}
+
+func TestOpenTimeout(t *testing.T) {
+	// the server never accepts the stream
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), StreamAcceptDeadline: time.Minute})
+	defer session.Close()
+
+	start := time.Now()
+	if _, err := session.OpenTimeout(100 * time.Millisecond); err != ErrAcceptTimeout {
+		t.Fatalf("expected ErrAcceptTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("OpenTimeout used the session deadline: took %v", elapsed)
+	}
+	if n := session.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams, got %d", n)
+	}
+}
+
+func TestAcceptContextCancelled(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = session.AcceptContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if session.IsClosed() {
+		t.Fatal("session should remain open")
+	}
+}
+
+func TestAcceptN(t *testing.T) {
+	sessions := make(chan *Session, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		sessions <- session
+		<-session.Done()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{Log: genLogger()})
+	defer client.Close()
+	session := <-sessions
+	defer session.Close()
+
+	const streams = 5
+	opened := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		go func() {
+			_, err := client.Open()
+			opened <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(session.streamCh) < streams {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued streams, got %d", streams, len(session.streamCh))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queued streams are returned in batches of at most n
+	conns, err := session.AcceptN(context.Background(), 3)
+	if err != nil || len(conns) != 3 {
+		t.Fatalf("expected 3 streams, got %d, %v", len(conns), err)
+	}
+	conns, err = session.AcceptN(context.Background(), 10)
+	if err != nil || len(conns) != 2 {
+		t.Fatalf("expected the remaining 2 streams, got %d, %v", len(conns), err)
+	}
+	for i := 0; i < streams; i++ {
+		if err := <-opened; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := session.AcceptN(ctx, 10); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestOnAccept(t *testing.T) {
+	accepted := make(chan uint32, 3)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{
+			Log: genLogger(),
+			OnAccept: func(id uint32) (uint32, bool) {
+				switch id {
+				case 1:
+					return 4096, true
+				case 3:
+					return 0, false
+				}
+				return 0, true
+			},
+		})
+		for {
+			str, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			accepted <- str.(*stream).id
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	// the window advertised for stream 1 is overridden
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credit := str.SendCredit(); credit != 4096 {
+		t.Fatalf("expected 4096 bytes of credit, got %d", credit)
+	}
+
+	// stream 3 is rejected, and reset
+	if _, err := session.Open(); err != ErrStreamRefused {
+		t.Fatalf("expected ErrStreamRefused, got %v", err)
+	}
+
+	// stream 5 gets the default window
+	str, err = session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credit := str.SendCredit(); credit != DefaultCapacity {
+		t.Fatalf("expected %d bytes of credit, got %d", DefaultCapacity, credit)
+	}
+
+	// Accept skipped the rejected stream
+	for _, id := range []uint32{1, 5} {
+		if got := <-accepted; got != id {
+			t.Fatalf("expected stream %d to be accepted, got %d", id, got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err = io.Copy(final, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := session.Stats()
+	if stats.StreamsOpened != 1 || stats.ActiveStreams != 1 {
+		t.Fatalf("bad stream counts: %+v", stats)
+	}
+	if stats.BytesSent != 5 || stats.BytesReceived != 5 {
+		t.Fatalf("bad byte counts: %+v", stats)
+	}
+	if stats.FramesSent.SYN != 1 || stats.FramesSent.FIN != 1 || stats.FramesReceived.FIN != 1 {
+		t.Fatalf("bad frame counts: %+v", stats)
+	}
+	if stats.FramesReceived.ACK == 0 {
+		t.Fatalf("no ACK frames counted: %+v", stats)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, limitedConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{MaxStreams: 2, Log: genLogger()})
+	defer session.Close()
+
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// the remote end only allows one stream
+	if _, err := session.Open(); err != ErrStreamRefused {
+		t.Fatalf("expected ErrStreamRefused, got %v", err)
+	}
+	// the refused stream was removed, so one more can be tracked locally..
+	session.mu.Lock()
+	session.streams[1000] = newStream(1000, session)
+	session.mu.Unlock()
+	// ..but no more than that
+	if _, err := session.Open(); err != ErrTooManyStreams {
+		t.Fatalf("expected ErrTooManyStreams, got %v", err)
+	}
+}
+
+func TestAcceptQueueFull(t *testing.T) {
+	// the server never accepts streams, so its accept queue fills up
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{StreamAcceptDeadline: time.Second, Log: genLogger()})
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, defaultStreamQueueSize+1)
+	for i := 0; i < defaultStreamQueueSize+1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := session.Open()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	refused := 0
+	for err := range errs {
+		switch err {
+		case ErrStreamRefused:
+			refused++
+		case ErrAcceptTimeout:
+		default:
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if refused != 1 {
+		t.Fatalf("expected exactly one refused stream, got %d", refused)
+	}
+	if session.IsClosed() {
+		t.Fatal("session should remain open")
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errChan <- session.CloseGracefully(ctx)
+	}()
+
+	// CloseGracefully sent a FIN, so the echo server replies and closes
+	final := new(bytes.Buffer)
+	if _, err = io.Copy(final, stream); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != "Hello" {
+		t.Fatalf("bad message %q", final.String())
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if !session.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+}
+
+func TestCloseGracefullyTimeout(t *testing.T) {
+	// the server accepts the stream but never closes it
+	server := httptest.NewServer(genWebSocketHandler(t, timeoutConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	if _, err = session.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := session.CloseGracefully(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if !session.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+}
+
+func TestCloseGracefullyConnectionLost(t *testing.T) {
+	kill := make(chan struct{})
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		if _, err := session.Accept(); err != nil {
+			return
+		}
+		// the connection is lost while the stream is draining
+		<-kill
+		_ = conn.UnderlyingConn().Close()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	if _, err = session.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errChan <- session.CloseGracefully(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(kill)
+
+	select {
+	case err := <-errChan:
+		if err == nil || err == context.DeadlineExceeded {
+			t.Fatalf("expected the session's error, got %v", err)
+		}
+		if err != session.Err() {
+			t.Fatalf("expected %v, got %v", session.Err(), err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CloseGracefully did not return")
+	}
+}
+
+func TestDial(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err = io.Copy(final, stream); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != "Hello" {
+		t.Fatalf("bad message %q", final.String())
+	}
+}
+
+func TestDialCancelled(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Dial(ctx, util.MakeWsURL(server.URL), Config{}); err == nil {
+		t.Fatal("dial with a cancelled context should fail")
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		timeout, expected time.Duration
+	}{
+		{0, websocket.DefaultDialer.HandshakeTimeout},
+		{time.Second, time.Second},
+		{-1, 0},
+	} {
+		if d := (Config{HandshakeTimeout: tc.timeout}).dialer().HandshakeTimeout; d != tc.expected {
+			t.Errorf("HandshakeTimeout %v: expected dialer timeout %v, got %v", tc.timeout, tc.expected, d)
+		}
+	}
+}
+
+func TestStreamCallbacks(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m sync.Mutex
+	var opened, closed []uint32
+	session := Client(conn, Config{
+		Log: genLogger(),
+		OnStreamOpen: func(id uint32) {
+			m.Lock()
+			defer m.Unlock()
+			opened = append(opened, id)
+		},
+		OnStreamClose: func(id uint32) {
+			m.Lock()
+			defer m.Unlock()
+			closed = append(closed, id)
+		},
+	})
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := str.(*stream).id
+	m.Lock()
+	if len(opened) != 1 || opened[0] != id || len(closed) != 0 {
+		t.Fatalf("bad callbacks after open: opened %v, closed %v", opened, closed)
+	}
+	m.Unlock()
+
+	_ = session.Close()
+	m.Lock()
+	defer m.Unlock()
+	if len(closed) != 1 || closed[0] != id {
+		t.Fatalf("bad callbacks after close: opened %v, closed %v", opened, closed)
+	}
+}
+
+func TestRemoteCloseCallback(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, closingConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := make(chan struct{}, 2)
+	session := Client(conn, Config{
+		Log:                 genLogger(),
+		RemoteCloseCallback: func() { called <- struct{}{} },
+	})
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("remote close callback was not invoked")
+	}
+	if !session.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+	_ = session.Close()
+	select {
+	case <-called:
+		t.Fatal("remote close callback invoked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRemoteCloseCallbackLocalClose(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := make(chan struct{}, 1)
+	session := Client(conn, Config{
+		Log:                 genLogger(),
+		RemoteCloseCallback: func() { called <- struct{}{} },
+	})
+	_ = session.Close()
+
+	select {
+	case <-called:
+		t.Fatal("remote close callback invoked for local close")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMalformedFramesDiscarded(t *testing.T) {
+	result := make(chan string, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		// the server's first stream has id 0
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(str, buf)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		result <- string(buf)
+	}))
+	defer server.Close()
+
+	// speak the protocol directly on the client side
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn, err := deserializeFrame(msg)
+	if err != nil || syn.msg != msgSYN || syn.id != 0 {
+		t.Fatal("expected SYN frame for stream 0")
+	}
+	messages := [][]byte{
+		newAckFrame(0, DefaultCapacity).serialize(),
+		// short header, which would be a FIN for stream 0 if zero-filled
+		{msgFIN},
+		// invalid message type
+		{msgMax + 1, 0, 0, 0, 0},
+		// truncated ACK
+		{msgACK, 0, 0, 0, 0, 1},
+		newDataFrame(0, []byte("ok")).serialize(),
+	}
+	for _, m := range messages {
+		if err := conn.WriteMessage(websocket.BinaryMessage, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case r := <-result:
+		if r != "ok" {
+			t.Fatalf("expected data to be received, got %q", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("data not received")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	negotiated := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		negotiated <- r.Header.Get("Sec-Websocket-Extensions") != ""
+		session := Server(conn, Config{Log: genLogger(), EnableCompression: true})
+		str, err := session.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(str, str)
+		_ = str.Close()
+	}))
+	defer server.Close()
+
+	conf := Config{Log: genLogger(), EnableCompression: true, CompressionLevel: 9}
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if !<-negotiated {
+		t.Fatal("compression extension was not requested")
+	}
+
+	if err := session.SetCompressionLevel(100); err == nil {
+		t.Fatal("expected an error for an invalid compression level")
+	}
+	if err := session.SetCompressionLevel(1); err != nil {
+		t.Fatal(err)
+	}
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("compressible "), 1000)
+	go func() {
+		_, _ = str.Write(msg)
+		_ = str.CloseWrite()
+	}()
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(final.Bytes(), msg) {
+		t.Fatalf("bad message of length %d", final.Len())
+	}
+}
+
+func TestWrongParitySynRefused(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		for {
+			if _, err := session.Accept(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the server opens even-numbered streams, so a client may not use 2
+	for _, id := range []uint32{2, 3} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, newSynFrame(id, DefaultCapacity, nil).serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := map[uint32]byte{}
+	for len(got) < 2 {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr, err := deserializeFrame(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[fr.id] = fr.msg
+	}
+	if got[2] != msgRST {
+		t.Fatalf("expected stream 2 to be reset, got %v", got[2])
+	}
+	if got[3] != msgACK {
+		t.Fatalf("expected stream 3 to be accepted, got %v", got[3])
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "restarting")
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	if code, _ := session.CloseError(); code != 0 {
+		t.Fatalf("expected no close code before closing, got %d", code)
+	}
+
+	if _, err := session.Accept(); err == nil {
+		t.Fatal("expected Accept to fail after remote close")
+	}
+	code, reason := session.CloseError()
+	if code != websocket.CloseGoingAway || reason != "restarting" {
+		t.Fatalf("unexpected close error %d %q", code, reason)
+	}
+}
+
+func TestBatchWrites(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flush only when other frames are sent, or explicitly
+	session := Client(conn, Config{Log: genLogger(), BatchWrites: true, BatchFlushInterval: time.Hour})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if _, err := str.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dat := session.Stats().FramesSent.DAT; dat != 0 {
+		t.Fatalf("expected writes to be queued, but %d DAT frames were sent", dat)
+	}
+	if err := session.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if dat := session.Stats().FramesSent.DAT; dat != 1 {
+		t.Fatalf("expected writes to be coalesced into one DAT frame, got %d", dat)
+	}
+
+	// queued data is sent before the FIN from Close
+	if _, err := str.Write([]byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != strings.Repeat("0123456789", 50)+"end" {
+		t.Fatalf("bad message %q", final.String())
+	}
+}
+
+func TestBatchWritesFlushInterval(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), BatchWrites: true, BatchFlushInterval: 10 * time.Millisecond})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for session.Stats().FramesSent.DAT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batched data was not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	dial := func(conf Config) *Session {
+		conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Client(conn, conf)
+	}
+
+	idleClosed := make(chan struct{})
+	session := dial(Config{
+		Log:                genLogger(),
+		SessionIdleTimeout: 100 * time.Millisecond,
+		OnIdleClose:        func() { close(idleClosed) },
+	})
+	select {
+	case <-idleClosed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	if !session.IsClosed() {
+		t.Fatal("session should be closed when OnIdleClose is called")
+	}
+
+	// a session with an open stream is not idle
+	busy := dial(Config{Log: genLogger(), SessionIdleTimeout: 100 * time.Millisecond})
+	defer busy.Close()
+	if _, err := busy.Open(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if busy.IsClosed() {
+		t.Fatal("session with an open stream should not be closed")
+	}
+}
+
+func TestNumStreams(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+
+	for i := 1; i <= 3; i++ {
+		if _, err := session.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if n := session.NumStreams(); n != i {
+			t.Fatalf("expected %d streams, got %d", i, n)
+		}
+	}
+	_ = session.Close()
+	if n := session.NumStreams(); n != 0 {
+		t.Fatalf("expected 0 streams after Close, got %d", n)
+	}
+}
+
+func TestFramesAfterClose(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	_ = session.Close()
+
+	// none of these may panic on the closed session
+	session.handleSyn(&frame{id: 2, msg: msgSYN})
+	session.handleMessage(newDataFrame(2, []byte("late")).serialize())
+	session.handleRst(2)
+	session.removeStream(2)
+	if _, err := session.Open(); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	if n := session.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams, got %d", n)
+	}
+}
+
+func TestConcurrentOpen(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	const n = 100
+	ids := make(chan uint32, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			str, err := session.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- str.(*stream).id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[uint32]bool{}
+	for id := range ids {
+		if id%2 != 1 {
+			t.Fatalf("client opened stream with even id %d", id)
+		}
+		if seen[id] {
+			t.Fatalf("stream id %d allocated twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d streams, got %d", n, len(seen))
+	}
+}
+
+// TestConcurrentOpenAcceptClose opens and accepts streams in both directions
+// while the session is closed, by either end or both at once, checking that
+// every call returns and the sessions are left with no streams or goroutines.
+// It is most useful with -race.
+func TestConcurrentOpenAcceptClose(t *testing.T) {
+	for _, closer := range []string{"client", "server", "both", "shutdown"} {
+		t.Run(closer, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				concurrentOpenAcceptClose(t, closer)
+			}
+		})
+	}
+}
+
+func concurrentOpenAcceptClose(t *testing.T, closer string) {
+	sessions := make(chan *Session, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), AcceptQueueSize: 4})
+		sessions <- session
+		<-session.Done()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{Log: genLogger(), AcceptQueueSize: 4})
+	srv := <-sessions
+
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	for _, session := range []*Session{client, srv} {
+		session := session
+		for i := 0; i < 4; i++ {
+			run(func() {
+				for !session.IsClosed() {
+					str, err := session.Open()
+					if err != nil {
+						continue
+					}
+					// read the echo while writing, as the session closes
+					run(func() { _, _ = io.Copy(ioutil.Discard, str) })
+					_ = str.SetDeadline(time.Now().Add(time.Second))
+					_, _ = str.Write([]byte("hello"))
+					_ = str.Close()
+				}
+			})
+			run(func() {
+				for {
+					str, err := session.AcceptStream()
+					if err != nil {
+						return
+					}
+					run(func() {
+						_, _ = io.Copy(str, str)
+						_ = str.Close()
+					})
+				}
+			})
+		}
+		run(func() {
+			for {
+				conns, err := session.AcceptN(context.Background(), 3)
+				for _, c := range conns {
+					_ = c.Close()
+				}
+				if err != nil {
+					return
+				}
+			}
+		})
+	}
+
+	time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+	switch closer {
+	case "client":
+		_ = client.Close()
+	case "server":
+		_ = srv.Close()
+	case "both":
+		run(func() { _ = client.Close() })
+		run(func() { _ = srv.Close() })
+	case "shutdown":
+		run(func() { _ = client.Shutdown() })
+		run(func() { _ = client.Close() })
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("operations did not return after the session closed")
+	}
+
+	// closing either end closes the other
+	for _, session := range []*Session{client, srv} {
+		select {
+		case <-session.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("session did not close")
+		}
+		if err := session.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		if n := session.NumStreams(); n != 0 {
+			t.Fatalf("expected no streams after close, got %d", n)
+		}
+	}
+}
+
+func TestStreamIDWraparound(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	// the last client id, and the first after wrapping, are in use
+	session.mu.Lock()
+	session.nextID = math.MaxUint32
+	session.streams[math.MaxUint32] = newStream(math.MaxUint32, session)
+	session.streams[1] = newStream(1, session)
+	session.mu.Unlock()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := str.(*stream).id; id != 3 {
+		t.Fatalf("expected the next free id 3 after wrapping, got %d", id)
+	}
+}
+
+func TestTextMessages(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), TextMessages: true})
+		str, err := session.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(str, str)
+		_ = str.Close()
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), TextMessages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte{0, 1, 2, 0xff, 'h', 'i'}
+	if _, err := str.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(final.Bytes(), msg) {
+		t.Fatalf("bad message %v", final.Bytes())
+	}
+	if dropped := session.Stats().MessagesDropped; dropped != 0 {
+		t.Fatalf("expected no dropped messages, got %d", dropped)
+	}
+}
+
+func TestTextMessagesDropped(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("not a frame"))
+		idleConn(t, conn)
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	deadline := time.Now().Add(time.Second)
+	for session.Stats().MessagesDropped != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("text message was not counted as dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if session.IsClosed() {
+		t.Fatal("session should remain open")
+	}
+}
+
+func TestRTT(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{KeepAliveInterval: 50 * time.Millisecond, Log: genLogger()})
+	defer session.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for session.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no RTT measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rtt := session.RTT(); rtt < 0 || rtt > time.Second {
+		t.Fatalf("implausible RTT %v", rtt)
+	}
+
+	// samples are smoothed
+	var smoothed Session
+	smoothed.updateRTT(800)
+	smoothed.updateRTT(0)
+	if smoothed.RTT() != 700 {
+		t.Fatalf("expected smoothed RTT of 700ns, got %v", smoothed.RTT())
+	}
+}
+
+func TestStartDraining(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	existing, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := session.Accept()
+		acceptErr <- err
+	}()
+
+	session.StartDraining()
+	select {
+	case err := <-acceptErr:
+		if err != ErrDraining {
+			t.Fatalf("expected ErrDraining from Accept, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after StartDraining")
+	}
+	if _, err := session.Open(); err != ErrDraining {
+		t.Fatalf("expected ErrDraining from Open, got %v", err)
+	}
+
+	// new remote streams are refused
+	session.handleSyn(&frame{id: 2, msg: msgSYN})
+	if n := session.NumStreams(); n != 1 {
+		t.Fatalf("expected only the existing stream, got %d streams", n)
+	}
+
+	// the existing stream continues to work
+	if _, err := existing.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := existing.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, existing); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != "Hello" {
+		t.Fatalf("bad message %q", final.String())
+	}
+	if session.IsClosed() {
+		t.Fatal("session should remain open")
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	result := make(chan error, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), MaxFrameSize: 16})
+		str, err := session.Open()
+		if err != nil {
+			result <- err
+			return
+		}
+		_, err = str.Read(make([]byte, 100))
+		result <- err
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syn, err := deserializeFrame(msg); err != nil || syn.msg != msgSYN {
+		t.Fatal("expected SYN frame")
+	}
+	messages := [][]byte{
+		newAckFrame(0, DefaultCapacity).serialize(),
+		newDataFrame(0, bytes.Repeat([]byte("x"), 17)).serialize(),
+	}
+	for _, m := range messages {
+		if err := conn.WriteMessage(websocket.BinaryMessage, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oversized frame resets the stream
+	_, msg, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, err := deserializeFrame(msg); err != nil || rst.msg != msgRST || rst.id != 0 {
+		t.Fatalf("expected RST frame for stream 0, got %v", msg)
+	}
+	select {
+	case err := <-result:
+		if err != ErrStreamClosed {
+			t.Fatalf("expected ErrStreamClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read did not fail")
+	}
+}
+
+func TestMaxFrameSizeWrites(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+
+	var mu sync.Mutex
+	largest := 0
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+		Log:          genLogger(),
+		MaxFrameSize: 100,
+		FrameInterceptor: func(dir Direction, f FrameInfo) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if dir == Outbound && f.Length > largest {
+				largest = f.Length
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if largest != 100 {
+		t.Fatalf("expected frames of at most 100 bytes, got %d", largest)
+	}
+}
+
+func TestWriteErrorClosesSession(t *testing.T) {
+	// the server accepts two streams, and then stops reading, so that it
+	// does not notice the client's half-close
+	done := make(chan struct{})
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		for i := 0; i < 2; i++ {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			syn, err := deserializeFrame(msg)
+			if err != nil || syn.msg != msgSYN {
+				return
+			}
+			_ = conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, DefaultCapacity).serialize())
+		}
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := other.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	// writes now fail, but reads from the connection continue to work
+	if err := conn.UnderlyingConn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = str.Write([]byte("Hello"))
+	if err == nil {
+		t.Fatal("expected write to fail")
+	}
+	// the error identifies the frame, and wraps the underlying error
+	if !strings.HasPrefix(err.Error(), fmt.Sprintf("wsmux: writing DAT frame for stream %d: ", str.ID())) {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("expected the error to wrap a *net.OpError, got %v", err)
+	}
+
+	select {
+	case err := <-readErr:
+		if err != ErrSessionClosed {
+			t.Fatalf("expected ErrSessionClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed after a write error")
+	}
+	if !session.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+}
+
+func TestDialHeaders(t *testing.T) {
+	auth := make(chan string, 1)
+	handler := genWebSocketHandler(t, idleConn)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	headers := make(http.Header)
+	headers.Set("Authorization", "Bearer abc123")
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), DialHeaders: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if got := <-auth; got != "Bearer abc123" {
+		t.Fatalf("expected Authorization header to be sent, got %q", got)
+	}
+}
+
+func TestSubprotocols(t *testing.T) {
+	type upgraded struct {
+		session *Session
+		err     error
+	}
+	results := make(chan upgraded, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := Upgrade(w, r, Config{Log: genLogger(), Subprotocols: []string{"wsmux.v2", "wsmux.v1"}})
+		results <- upgraded{session, err}
+		if err == nil {
+			<-session.Done()
+		}
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), Subprotocols: []string{"wsmux.v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	remote := <-results
+	if remote.err != nil {
+		t.Fatal(remote.err)
+	}
+	if p := session.Subprotocol(); p != "wsmux.v1" {
+		t.Fatalf("expected client subprotocol wsmux.v1, got %q", p)
+	}
+	if p := remote.session.Subprotocol(); p != "wsmux.v1" {
+		t.Fatalf("expected server subprotocol wsmux.v1, got %q", p)
+	}
+
+	// clients offering no supported subprotocol are rejected
+	for _, offered := range [][]string{nil, {"wsmux.v3"}} {
+		_, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), Subprotocols: offered})
+		if err != websocket.ErrBadHandshake {
+			t.Fatalf("expected ErrBadHandshake offering %v, got %v", offered, err)
+		}
+		if remote := <-results; remote.err != ErrUnsupportedSubprotocol {
+			t.Fatalf("expected ErrUnsupportedSubprotocol offering %v, got %v", offered, remote.err)
+		}
+	}
+}
+
+func TestOpenTimeoutResetsStream(t *testing.T) {
+	frames := make(chan frame, 10)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		defer close(frames)
+		accepted := false
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			fr, err := deserializeFrame(msg)
+			if err != nil {
+				return
+			}
+			frames <- fr
+			// after the opener gives up, accept the stream and send data
+			// anyway
+			if fr.msg == msgRST && !accepted {
+				accepted = true
+				for _, f := range []frame{newAckFrame(fr.id, DefaultCapacity), newDataFrame(fr.id, []byte("late"))} {
+					_ = conn.WriteMessage(websocket.BinaryMessage, f.serialize())
+				}
+			}
+		}
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), StreamAcceptDeadline: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.Open(); err != ErrAcceptTimeout {
+		t.Fatalf("expected ErrAcceptTimeout, got %v", err)
+	}
+
+	next := func() frame {
+		select {
+		case fr := <-frames:
+			return fr
+		case <-time.After(2 * time.Second):
+			t.Fatal("no frame received")
+		}
+		return frame{}
+	}
+	syn := next()
+	if syn.msg != msgSYN {
+		t.Fatalf("expected SYN, got %v", syn)
+	}
+	if rst := next(); rst.msg != msgRST || rst.id != syn.id {
+		t.Fatalf("expected RST for the abandoned stream, got %v", rst)
+	}
+	// the late data is answered with another RST
+	if rst := next(); rst.msg != msgRST || rst.id != syn.id {
+		t.Fatalf("expected RST for data on the abandoned stream, got %v", rst)
+	}
+	if n := session.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams, got %d", n)
+	}
+}
+
+func TestAcceptQueueSize(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		_ = Server(conn, Config{AcceptQueueSize: 2})
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{StreamAcceptDeadline: time.Second, Log: genLogger()})
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := session.Open()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	refused := 0
+	for err := range errs {
+		if err == ErrStreamRefused {
+			refused++
+		} else if err != ErrAcceptTimeout {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if refused != 1 {
+		t.Fatalf("expected exactly one refused stream, got %d", refused)
+	}
+}
+
+func TestAcceptQueueRetries(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{
+			AcceptQueueSize:          1,
+			AcceptQueueRetries:       100,
+			AcceptQueueRetryInterval: 10 * time.Millisecond,
+		})
+		// accept slowly, so that the queue is momentarily full
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := session.Accept(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{StreamAcceptDeadline: 5 * time.Second, Log: genLogger()})
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := session.Open()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("expected all streams to be accepted, got %v", err)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// the server accepts a stream with a huge window, and then stops reading
+	done := make(chan struct{})
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		syn, err := deserializeFrame(msg)
+		if err != nil || syn.msg != msgSYN {
+			return
+		}
+		_ = conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, 1<<30).serialize())
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), WriteTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := str.Write(make([]byte, 64*1024*1024))
+		writeErr <- err
+	}()
+	select {
+	case err := <-writeErr:
+		if err == nil {
+			t.Fatal("expected write to fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write did not time out")
+	}
+	select {
+	case <-session.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed after a write timeout")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, silentConn))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	select {
+	case <-session.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed after the read timeout")
+	}
+}
+
+func TestReadTimeoutExtendedByPings(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		go silentConn(t, conn)
+		for i := 0; i < 10; i++ {
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	time.Sleep(250 * time.Millisecond)
+	if session.IsClosed() {
+		t.Fatal("session should remain open while the remote end sends pings")
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt, err := session.Ping(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if rtt <= 0 || rtt > time.Second {
+				t.Errorf("implausible RTT %v", rtt)
+			}
+		}()
+	}
+	wg.Wait()
+	if session.RTT() == 0 {
+		t.Fatal("Ping should contribute to the RTT estimate")
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if len(session.pings) != 0 {
+		t.Fatalf("expected no outstanding pings, got %d", len(session.pings))
+	}
+}
+
+func TestConcurrentPingsAndWrites(t *testing.T) {
+	// pings and pongs are written by both ends while data is written in both
+	// directions; run with -race to check that writes are serialized
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), KeepAliveInterval: 20 * time.Millisecond, ReadTimeout: 5 * time.Second})
+		for {
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(str, str)
+				_ = str.Close()
+			}()
+		}
+	}))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), KeepAliveInterval: 20 * time.Millisecond, ReadTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	done := make(chan struct{})
+	var pings sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		pings.Add(1)
+		go func() {
+			defer pings.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := session.Ping(context.Background()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			str, err := session.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+			go func() {
+				_, _ = str.Write(data)
+				_ = str.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(str)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("echoed data differs: got %d bytes, want %d", len(got), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	pings.Wait()
+	if session.IsClosed() {
+		t.Fatal("session should still be open")
+	}
+}
+
+func TestPingContext(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, silentConn))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := session.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	_ = session.Close()
+	if _, err := session.Ping(context.Background()); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestStreamIDs(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+
+	for i := 0; i < 3; i++ {
+		if _, err := session.Open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// out-of-order IDs are still returned in ascending order
+	session.mu.Lock()
+	session.nextID = 101
+	session.mu.Unlock()
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+	session.mu.Lock()
+	session.nextID = 51
+	session.mu.Unlock()
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := session.StreamIDs(); !reflect.DeepEqual(ids, []uint32{1, 3, 5, 51, 101}) {
+		t.Fatalf("unexpected stream IDs %v", ids)
+	}
+	_ = session.Close()
+	if ids := session.StreamIDs(); len(ids) != 0 {
+		t.Fatalf("expected no stream IDs after Close, got %v", ids)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	server := httptest.NewTLSServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	url := "wss" + strings.TrimPrefix(server.URL, "https")
+
+	// the test server's certificate is not trusted by default
+	if _, err := Dial(context.Background(), url, Config{Log: genLogger()}); err == nil {
+		t.Fatal("expected Dial to fail without trusting the server certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	session, err := Dial(context.Background(), url, Config{Log: genLogger(), TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = session.Close()
+}
+
+func TestOpenWithMeta(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, metaConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	meta := []byte("service=echo;tenant=42")
+	str, err := session.OpenWithMeta(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(str.Metadata(), meta) {
+		t.Fatalf("opened stream has metadata %q", str.Metadata())
+	}
+	got, err := ioutil.ReadAll(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, meta) {
+		t.Fatalf("remote end received metadata %q, expected %q", got, meta)
+	}
+
+	// streams opened without metadata have none
+	str, err = session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(str); err != nil || len(got) != 0 {
+		t.Fatalf("expected no metadata, got %q, %v", got, err)
+	}
+
+	if _, err := session.OpenWithMeta(make([]byte, MaxMetadataSize+1)); err != ErrMetadataTooLarge {
+		t.Fatalf("expected ErrMetadataTooLarge, got %v", err)
+	}
+	if ids := session.StreamIDs(); len(ids) > 2 {
+		t.Fatalf("oversized metadata should not create a stream: %v", ids)
+	}
+}
+
+func TestOversizedMetadataRefused(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, metaConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsts := make(chan uint32, 1)
+	session := Client(conn, Config{
+		Log: genLogger(),
+		FrameInterceptor: func(dir Direction, f FrameInfo) error {
+			if dir == Inbound && f.Type == FrameRST {
+				rsts <- f.StreamID
+			}
+			return nil
+		},
+	})
+	defer session.Close()
+
+	// bypass the local check, as a misbehaving remote end might
+	if err := session.send(newSynFrame(1, DefaultCapacity, make([]byte, MaxMetadataSize+1))); err != nil {
+		t.Fatal(err)
+	}
+	// the remote end resets the stream rather than accepting it
+	select {
+	case id := <-rsts:
+		if id != 1 {
+			t.Fatalf("unexpected RST for stream %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized metadata was not refused")
+	}
+
+	// the session is unaffected
+	str, err := session.OpenWithMeta([]byte("ok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(str); err != nil || string(got) != "ok" {
+		t.Fatalf("unexpected read %q, %v", got, err)
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	violations := map[string]struct {
+		msg  []byte
+		want ProtocolError
+	}{
+		"malformed frame":  {[]byte{msgACK, 0, 0, 0, 0, 1, 2}, ProtocolError{Kind: ErrMalformedFrame}},
+		"malformed header": {[]byte{msgDAT, 0}, ProtocolError{Kind: ErrMalformedHeader}},
+		"malformed batch":  {[]byte{msgBAT, 0, 0, 0, 0, 100, 0, 0, 0}, ProtocolError{Kind: ErrMalformedFrame}},
+		"wrong parity SYN": {newSynFrame(2, DefaultCapacity, nil).serialize(), ProtocolError{Kind: ErrInvalidStreamID, StreamID: 2, HasStreamID: true}},
+	}
+	for _, strict := range []bool{false, true} {
+		for name, v := range violations {
+			t.Run(fmt.Sprintf("%s/strict=%v", name, strict), func(t *testing.T) {
+				sessions := make(chan *Session, 1)
+				reported := make(chan error, 1)
+				onProtocolError := func(err error) { reported <- err }
+				server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+					session := Server(conn, Config{Log: genLogger(), StrictProtocol: strict, OnProtocolError: onProtocolError})
+					sessions <- session
+					<-session.closed
+				}))
+				defer server.Close()
+
+				conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				session := <-sessions
+				defer session.Close()
+
+				messages := [][]byte{v.msg, newSynFrame(1, DefaultCapacity, nil).serialize()}
+				for _, m := range messages {
+					if err := conn.WriteMessage(websocket.BinaryMessage, m); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				select {
+				case err := <-reported:
+					var pe *ProtocolError
+					if !errors.As(err, &pe) || *pe != v.want {
+						t.Fatalf("expected %v to be reported, got %v", &v.want, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("protocol violation was not reported")
+				}
+
+				if strict {
+					select {
+					case <-session.closed:
+					case <-time.After(5 * time.Second):
+						t.Fatal("session should close on a protocol violation")
+					}
+					if err := session.Err(); !errors.Is(err, v.want.Kind) {
+						t.Fatalf("expected the violation as the close reason, got %v", err)
+					}
+					return
+				}
+				// the violation is skipped, and the following SYN works as usual
+				str, err := session.AcceptStream()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if str.ID() != 1 {
+					t.Fatalf("accepted unexpected stream %d", str.ID())
+				}
+				if session.IsClosed() {
+					t.Fatal("session should remain open")
+				}
+			})
+		}
+	}
+}
+
+func TestSessionDoneAndErr(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{})
+		<-session.Done()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+
+	select {
+	case <-session.Done():
+		t.Fatal("Done should not be closed while the session is open")
+	default:
+	}
+	if err := session.Err(); err != nil {
+		t.Fatalf("expected no error while open, got %v", err)
+	}
+
+	_ = session.Close()
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done should be closed after Close")
+	}
+	if err := session.Err(); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	queued := make(chan struct{})
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		// never accept, so that the second stream waits for the accept
+		// queue in its own goroutine
+		session := Server(conn, Config{
+			AcceptQueueSize:          1,
+			AcceptQueueRetries:       1000,
+			AcceptQueueRetryInterval: time.Hour,
+			FrameInterceptor: func(dir Direction, f FrameInfo) error {
+				if dir == Inbound && f.Type == FrameSYN && f.StreamID == 3 {
+					close(queued)
+				}
+				return nil
+			},
+		})
+		<-queued
+		done := make(chan error, 1)
+		go func() { done <- session.Shutdown() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("unexpected error from Shutdown: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Shutdown did not return")
+			return
+		}
+		// the session's goroutines have all exited
+		select {
+		case <-session.recvDone:
+		default:
+			t.Error("Shutdown returned before recvLoop")
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	for i := 0; i < 2; i++ {
+		go func() { _, _ = session.Open() }()
+	}
+	select {
+	case <-session.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server session did not shut down")
+	}
+}
+
+func TestShutdownWaitsForAbort(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	// every write times out, so the first aborts the session
+	session := Client(conn, Config{
+		Log:               genLogger(),
+		KeepAliveInterval: -1,
+		WriteTimeout:      time.Nanosecond,
+		CloseCallback: func() {
+			close(entered)
+			<-release
+		},
+	})
+	go func() { _, _ = session.Open() }()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not aborted")
+	}
+
+	// Shutdown waits for the goroutine aborting the session, which is still
+	// running the close callback
+	done := make(chan struct{})
+	go func() {
+		_ = session.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while the close callback was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestCloseRacingShutdown(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	for i := 0; i < 20; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// with BatchWrites, Close flushes in a goroutine of its own, which
+		// must not be started once Shutdown is waiting
+		session := Client(conn, Config{Log: genLogger(), BatchWrites: true})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = session.Close()
+		}()
+		_ = session.Shutdown()
+		wg.Wait()
+	}
+}
+
+func TestCloseFlushTimeout(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		for {
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// the session closes after the data, so errors are expected
+				b, _ := ioutil.ReadAll(str)
+				received <- string(b)
+			}()
+		}
+	}))
+	defer server.Close()
+
+	// hold up the first data frame in the send queue until released
+	release := make(chan struct{})
+	var once sync.Once
+	interceptor := func(dir Direction, f FrameInfo) error {
+		if dir == Outbound && f.Type == FrameDAT {
+			once.Do(func() { <-release })
+		}
+		return nil
+	}
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+		Log:               genLogger(),
+		FrameInterceptor:  interceptor,
+		CloseFlushTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := func() int {
+		session.sendQueue.mu.Lock()
+		defer session.sendQueue.mu.Unlock()
+		return session.sendQueue.pending
+	}
+
+	for _, data := range []string{"first", "second"} {
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(data string) { _, _ = str.Write([]byte(data)) }(data)
+	}
+	// the first write is blocked in the interceptor, and the second is queued
+	for pending() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_ = session.Close()
+		close(closed)
+	}()
+	for pending() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-closed
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			got[data] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream data not received")
+		}
+	}
+	if !got["first"] || !got["second"] {
+		t.Fatalf("expected all queued data to be written before closing, got %v", got)
+	}
+}
+
+func TestCloseWithBlockedWrite(t *testing.T) {
+	const window = 64 * 1024 * 1024
+	for _, batch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch=%v", batch), func(t *testing.T) {
+			// the peer grants a large window, and then stops reading, so that
+			// writes block on the connection
+			stop := make(chan struct{})
+			defer close(stop)
+			server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				syn, err := deserializeFrame(msg)
+				if err != nil || syn.msg != msgSYN {
+					return
+				}
+				_ = conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, window).serialize())
+				<-stop
+			}))
+			defer server.Close()
+			session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), BatchWrites: batch})
+			if err != nil {
+				t.Fatal(err)
+			}
+			str, err := session.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := make(chan error, 1)
+			go func() {
+				_, err := str.Write(make([]byte, window))
+				written <- err
+			}()
+			time.Sleep(200 * time.Millisecond)
+
+			closed := make(chan struct{})
+			go func() {
+				_ = session.Close()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close blocked on a write to a peer which stopped reading")
+			}
+			select {
+			case err := <-written:
+				if err == nil {
+					t.Fatal("expected the blocked write to fail")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("blocked write did not return")
+			}
+		})
+	}
+}
+
+func TestLeaveConnOpen(t *testing.T) {
+	writeErr := make(chan error, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), LeaveConnOpen: true})
+		if _, err := session.Accept(); err != nil {
+			writeErr <- err
+			return
+		}
+		if err := session.Close(); err != nil {
+			writeErr <- err
+			return
+		}
+		// the connection is still usable for writing
+		msg := websocket.FormatCloseMessage(4000, "handed off")
+		writeErr <- conn.WriteMessage(websocket.CloseMessage, msg)
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatalf("could not write after Close: %v", err)
+	}
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not closed by the remote end")
+	}
+	if code, reason := session.CloseError(); code != 4000 || reason != "handed off" {
+		t.Fatalf("unexpected close code %d, reason %q", code, reason)
+	}
+}
+
+func TestSynRetransmits(t *testing.T) {
+	// the server drops the first SYN, as if it had been lost, and accepts the
+	// stream when it is retransmitted
+	var dropped int32
+	interceptor := func(dir Direction, f FrameInfo) error {
+		if dir == Inbound && f.Type == FrameSYN && atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+			return errors.New("dropped")
+		}
+		return nil
+	}
+	sessions := make(chan *Session, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), FrameInterceptor: interceptor})
+		sessions <- session
+		for {
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(str, str)
+				_ = str.Close()
+			}()
+		}
+	}))
+	defer server.Close()
+
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+		Log:                   genLogger(),
+		StreamAcceptDeadline:  5 * time.Second,
+		SynRetransmits:        3,
+		SynRetransmitInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	remote := <-sessions
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dropped) != 1 {
+		t.Fatal("expected the first SYN to be dropped")
+	}
+
+	// a retransmission arriving after the stream is accepted is ignored,
+	// rather than resetting the stream
+	if err := session.send(newSynFrame(str.ID(), uint32(session.streamBufferSize), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(str)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("unexpected echo %q, %v", got, err)
+	}
+	if n := remote.Stats().StreamsAccepted; n != 1 {
+		t.Fatalf("expected one stream to be accepted, got %d", n)
+	}
+}
+
+func TestMaxTotalBuffer(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), MaxTotalBuffer: 2 * DefaultCapacity})
+		for {
+			if _, err := session.Accept(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), MaxTotalBuffer: 3 * DefaultCapacity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// the server has room for the windows of two streams
+	first, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Open(); err != ErrStreamRefused {
+		t.Fatalf("expected ErrStreamRefused, got %v", err)
+	}
+
+	// the client has room for one more window, so cannot grow a window by
+	// more than that
+	if err := first.SetReceiveWindow(3 * DefaultCapacity); err != ErrBufferLimit {
+		t.Fatalf("expected ErrBufferLimit, got %v", err)
+	}
+	if err := first.SetReceiveWindow(2 * DefaultCapacity); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Open(); err != ErrBufferLimit {
+		t.Fatalf("expected ErrBufferLimit, got %v", err)
+	}
+
+	// removing a stream releases its window at both ends
+	session.resetStream(first.ID())
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+}
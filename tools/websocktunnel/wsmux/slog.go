@@ -0,0 +1,58 @@
+//go:build go1.21
+// +build go1.21
+
+package wsmux
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// SlogLogger is a StructuredLogger which writes to a *log/slog.Logger.  Each
+// LogLevel maps to the corresponding slog level, and the stream ID, if any, is
+// included as the "stream" attribute.  Messages without a level are logged at
+// slog.LevelInfo.  If Logger is nil, it writes to slog.Default().
+//
+// Messages are only passed to slog up to Config.LogLevel, so set that to
+// LogLevelDebug to leave filtering to the slog handler.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+func (l SlogLogger) logger() *slog.Logger {
+	if l.Logger == nil {
+		return slog.Default()
+	}
+	return l.Logger
+}
+
+// Printf logs a message at slog.LevelInfo
+func (l SlogLogger) Printf(format string, a ...interface{}) {
+	l.logger().Info(fmt.Sprintf(format, a...))
+}
+
+// Print logs a message at slog.LevelInfo
+func (l SlogLogger) Print(a ...interface{}) {
+	l.logger().Info(fmt.Sprint(a...))
+}
+
+// Log logs a message at the slog level corresponding to its LogLevel
+func (l SlogLogger) Log(r LogRecord) {
+	var attrs []slog.Attr
+	if r.HasStreamID {
+		attrs = append(attrs, slog.Uint64("stream", uint64(r.StreamID)))
+	}
+	l.logger().LogAttrs(context.Background(), slogLevel(r.Level), r.Message, attrs...)
+}
+
+// slogLevel returns the slog level corresponding to a LogLevel
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelError:
+		return slog.LevelError
+	case LogLevelDebug:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
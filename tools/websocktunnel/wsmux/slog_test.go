@@ -0,0 +1,36 @@
+//go:build go1.21
+// +build go1.21
+
+package wsmux
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		// omit the time, for a predictable output
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	l := newLeveledLogger(SlogLogger{Logger: slog.New(handler)}, LogLevelDebug)
+	l.forStream(3).Errorf("refusing stream: %v", ErrTooManySyns)
+	l.Infof("session closed")
+	l.forStream(4).Debugf("reset")
+
+	expected := `level=ERROR msg="refusing stream: too many un-accepted new incoming streams" stream=3
+level=INFO msg="session closed"
+level=DEBUG msg=reset stream=4
+`
+	if buf.String() != expected {
+		t.Fatalf("got %q, want %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,103 @@
+package wsmux
+
+import (
+	"sync/atomic"
+)
+
+// FrameStats counts frames by message type.
+type FrameStats struct {
+	SYN uint64
+	DAT uint64
+	ACK uint64
+	FIN uint64
+	RST uint64
+
+	// SYNACK frames are only used from protocol version 2
+	SYNACK uint64
+}
+
+// Stats is a snapshot of the counters for a session, as returned from
+// `session.Stats()`.
+type Stats struct {
+	// StreamsOpened is the number of streams successfully opened with Open.
+	StreamsOpened uint64
+
+	// StreamsAccepted is the number of remote streams returned from Accept.
+	StreamsAccepted uint64
+
+	// StreamsClosed is the number of streams which have been removed from the session.
+	StreamsClosed uint64
+
+	// ActiveStreams is the number of streams currently tracked by the session.
+	ActiveStreams int
+
+	// BytesSent and BytesReceived count the payload bytes of data frames.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// FramesSent and FramesReceived count frames by message type.
+	FramesSent     FrameStats
+	FramesReceived FrameStats
+
+	// MessagesDropped counts websocket messages which were discarded because
+	// they were of the wrong type (for example, text messages when
+	// Config.TextMessages is not set) or could not be decoded.
+	MessagesDropped uint64
+}
+
+// sessionStats contains the counters for a session.  All fields are updated
+// atomically, and must remain 64-bit aligned.
+type sessionStats struct {
+	streamsOpened   uint64
+	streamsAccepted uint64
+	streamsClosed   uint64
+	bytesSent       uint64
+	bytesReceived   uint64
+	framesSent      [msgMax + 1]uint64
+	framesReceived  [msgMax + 1]uint64
+	messagesDropped uint64
+}
+
+// countFrame adds a frame to the given per-message-type counters, along with
+// its payload size if it is a data frame.
+func countFrame(frames *[msgMax + 1]uint64, bytes *uint64, f frame) {
+	if f.msg > msgMax {
+		return
+	}
+	atomic.AddUint64(&frames[f.msg], 1)
+	if f.msg == msgDAT {
+		atomic.AddUint64(bytes, uint64(len(f.payload)))
+	}
+}
+
+// loadFrameStats returns a FrameStats from the given per-message-type counters
+func loadFrameStats(frames *[msgMax + 1]uint64) FrameStats {
+	return FrameStats{
+		SYN: atomic.LoadUint64(&frames[msgSYN]),
+		DAT: atomic.LoadUint64(&frames[msgDAT]),
+		ACK: atomic.LoadUint64(&frames[msgACK]),
+		FIN: atomic.LoadUint64(&frames[msgFIN]),
+		RST: atomic.LoadUint64(&frames[msgRST]),
+
+		SYNACK: atomic.LoadUint64(&frames[msgSYNACK]),
+	}
+}
+
+// Stats returns a snapshot of the session's counters.
+func (s *Session) Stats() Stats {
+	s.mu.Lock()
+	active := len(s.streams)
+	s.mu.Unlock()
+
+	return Stats{
+		StreamsOpened:   atomic.LoadUint64(&s.stats.streamsOpened),
+		StreamsAccepted: atomic.LoadUint64(&s.stats.streamsAccepted),
+		StreamsClosed:   atomic.LoadUint64(&s.stats.streamsClosed),
+		ActiveStreams:   active,
+		BytesSent:       atomic.LoadUint64(&s.stats.bytesSent),
+		BytesReceived:   atomic.LoadUint64(&s.stats.bytesReceived),
+		FramesSent:      loadFrameStats(&s.stats.framesSent),
+		FramesReceived:  loadFrameStats(&s.stats.framesReceived),
+		MessagesDropped: atomic.LoadUint64(&s.stats.messagesDropped),
+	}
+}
@@ -1,10 +1,14 @@
 package wsmux
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
@@ -13,6 +17,13 @@ import (
 const (
 	// DefaultCapacity of read buffer.
 	DefaultCapacity = 1024
+
+	// DefaultMaxFrameSize is the default maximum frame payload size.
+	DefaultMaxFrameSize = 1024 * 1024
+
+	// MaxMetadataSize is the largest amount of metadata that can be attached
+	// to a stream with OpenWithMeta.
+	MaxMetadataSize = 4096
 )
 
 type streamState int
@@ -35,11 +46,105 @@ const (
 	streamDead
 )
 
+// ByteCounter is implemented by the streams returned from Open and Accept, to
+// count the data transferred on each stream.  Use a type assertion to access
+// it:
+//
+//	if bc, ok := conn.(wsmux.ByteCounter); ok {
+//		log.Printf("read %d, wrote %d", bc.BytesRead(), bc.BytesWritten())
+//	}
+type ByteCounter interface {
+	BytesRead() uint64
+	BytesWritten() uint64
+}
+
+// Stream is a bidirectional bytestream within a Session, as returned from
+// Open and AcceptStream.  It is a net.Conn with additional mux-specific
+// methods.
+type Stream interface {
+	net.Conn
+	ByteCounter
+
+	// ID returns the stream's ID within its session.  Streams opened by the
+	// client have odd IDs, and those opened by the server have even IDs.
+	ID() uint32
+
+	// Close closes the stream in both directions: pending and future reads
+	// fail with ErrStreamClosed, and data from the remote end which has not
+	// been read is discarded.  In earlier versions, Close only closed the
+	// stream for writing; callers which write, close, and then read the
+	// reply must use CloseWrite instead.
+	Close() error
+
+	// CloseWrite closes the stream for writing, while allowing further
+	// reads.
+	CloseWrite() error
+
+	// CloseWithData writes b and closes the stream for writing, so that the
+	// remote end reads b immediately before io.EOF.
+	CloseWithData(b []byte) error
+
+	// CloseAndWait closes the stream for writing, and waits until the remote
+	// end has closed it too.
+	CloseAndWait(ctx context.Context) error
+
+	// SetPriority sets the priority of data written to the stream.
+	SetPriority(priority uint8)
+
+	// SetNoDelay controls whether small writes are sent immediately, as for
+	// *net.TCPConn, or coalesced briefly.  The default is true.
+	SetNoDelay(noDelay bool) error
+
+	// Flush sends any data held back from writes by SetNoDelay(false).
+	Flush() error
+
+	// SetReceiveWindow changes the amount of data the remote end may send
+	// before the local application reads it.
+	SetReceiveWindow(n uint32) error
+
+	// Pause stops granting the remote end credit for data which has been
+	// read, so that it stalls once its current credit is used up.
+	Pause()
+
+	// Resume undoes Pause, granting the remote end credit for any data read
+	// while the stream was paused.
+	Resume() error
+
+	// SendCredit returns the number of bytes which may be written before
+	// Write blocks waiting for the remote end to grant more credit.
+	SendCredit() uint32
+
+	// ReceiveCredit returns the number of bytes the remote end may send
+	// before it must wait for this end to grant more credit.
+	ReceiveCredit() uint32
+
+	// Metadata returns the metadata the opener attached to the stream with
+	// OpenWithMeta, or nil if there is none.
+	Metadata() []byte
+
+	// Context returns a context which is canceled when the stream ends.  It
+	// carries the values of the context passed to OpenContext or
+	// AcceptContext.
+	Context() context.Context
+}
+
 // A stream represents a bidirectional bytestream within the context of a particular
 // Session.
 //
-// This struct implements net.Conn.
+// This struct implements Stream.
+//
+// Once a stream has been closed locally with Close, or reset by either end,
+// reads and writes fail with ErrStreamClosed; after CloseWrite, only writes
+// do.  If the session closes, writes fail with
+// ErrSessionClosed, and reads return any buffered data and then fail with
+// ErrSessionClosed, unless the remote end had already closed the stream, in
+// which case reads return io.EOF.
 type stream struct {
+	// number of bytes received from and sent to the remote end; accessed
+	// atomically, and first in the struct for 64-bit alignment
+	bytesRead    uint64
+	bytesWritten uint64
+
 	// id of the stream within the session
 	id uint32
 
@@ -49,8 +154,11 @@ type stream struct {
 	// used for broadcasting when streamClosed, data read, or data pushed to buffer
 	c *sync.Cond
 
-	// read buffer, containing bytes we have received
-	b *buffer
+	// read buffer, containing bytes we have received, and whether the stream
+	// has been closed for reading by Close, after which received data is
+	// discarded
+	b          *buffer
+	readClosed bool
 
 	// number of bytes that can be sent to remote (updated by receiving ACKs).
 	// This essentially tracks data that is "in flight" from here to the remote
@@ -59,15 +167,70 @@ type stream struct {
 	// cannot buffer data as quickly as we send it.
 	unblocked uint32
 
+	// number of bytes the remote end may send before it must wait for an ACK.
+	// This is the receive-side counterpart of `unblocked`, and is used to
+	// detect remote ends which do not respect the window.
+	recvWindow uint32
+
+	// receive window reserved from the session's MaxTotalBuffer, and whether
+	// it has been released because the stream was closed or removed from the
+	// session
+	reserved       uint32
+	bufferReleased bool
+
+	// the receive window size: Read sends ACKs to keep recvWindow plus the
+	// buffered data at this size.  See SetReceiveWindow.
+	window uint32
+
+	// while paused, no credit is granted; see Pause
+	paused bool
+
+	// For remotely-initiated streams, the send window to use once the stream
+	// is accepted, as advertised in the msgSYN frame
+	initialSendWindow uint32
+
+	// metadata supplied by the opener; immutable once the stream is created
+	meta []byte
+
+	// the stream's context, canceled when the stream becomes dead; see
+	// Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// priority of this stream's data in the session's send queue; accessed
+	// atomically so that it can be changed during a blocked Write
+	priority uint32
+
+	// with coalesce set (SetNoDelay(false)), written data is held in pending,
+	// and sent when it reaches coalesceSize, when the send window is used up,
+	// or when coalesceTimer fires.  The window is already reduced by the
+	// pending data.
+	coalesce      bool
+	pending       []byte
+	coalesceTimer *time.Timer
+
 	// error causes stream to close
 	endErr error
 
+	// time of the last data received or written, for Config.StreamIdleTimeout
+	lastActivity time.Time
+
+	// set when the session closes; see kill
+	killed bool
+
+	// error returned from Read once the buffer is empty, instead of io.EOF,
+	// when the session closed before the remote end closed the stream
+	killErr error
+
 	// current state of the stream
 	state streamState
 
 	// closed when stream is accepted. Used in session.Open()
 	accepted chan struct{}
 
+	// true if the remote end closed the stream before accepting it
+	refused bool
+
 	// associated session. used for sending frames and logging
 	session *Session
 
@@ -75,6 +238,10 @@ type stream struct {
 	readTimer  *time.Timer
 	writeTimer *time.Timer
 
+	// deadlines for read and write operations; the zero value means no deadline
+	readDeadline  time.Time
+	writeDeadline time.Time
+
 	// true when timers expire
 	readDeadlineExceeded  bool
 	writeDeadlineExceeded bool
@@ -86,12 +253,23 @@ func newStream(id uint32, session *Session) *stream {
 	if session == nil {
 		panic("session must not be nil")
 	}
+	var b *buffer
+	if session.bufferPool != nil {
+		b = session.bufferPool.Get().(*buffer)
+	} else {
+		b = newBuffer(session.streamBufferSize)
+	}
 	str := &stream{
-		id:        id,
-		b:         newBuffer(session.streamBufferSize),
-		unblocked: 0,
-		state:     streamCreated,
-		accepted:  make(chan struct{}),
+		id:           id,
+		b:            b,
+		unblocked:    0,
+		recvWindow:   uint32(session.streamBufferSize),
+		window:       uint32(session.streamBufferSize),
+		reserved:     uint32(session.streamBufferSize),
+		priority:     uint32(DefaultPriority),
+		lastActivity: session.clock.Now(),
+		state:        streamCreated,
+		accepted:     make(chan struct{}),
 
 		endErr: nil,
 
@@ -103,6 +281,7 @@ func newStream(id uint32, session *Session) *stream {
 		session: session,
 	}
 
+	str.ctx, str.cancel = context.WithCancel(context.Background())
 	str.c = sync.NewCond(&str.m)
 
 	return str
@@ -112,36 +291,73 @@ func newStream(id uint32, session *Session) *stream {
 func (s *stream) handleFrame(fr frame) {
 	switch fr.msg {
 	case msgACK:
+		// a msgACK adds to the send window.  In version 1, the first msgACK
+		// instead accepts a stream opened locally, giving its initial send
+		// window.  Note that there is no fallthrough from any case.
 		cap := binary.LittleEndian.Uint32(fr.payload)
-		select {
-		case <-s.accepted:
-			// stream is already accepted, so broadcast the increased capacity
+		if s.isAccepted() {
 			s.unblockAndBroadcast(cap)
-		default:
-			// stream is not yet accepted, so mark it accepted
+		} else if s.session.Version() < 2 {
 			s.acceptStream(cap)
+		} else {
+			s.unexpectedFrame(fr)
+		}
+
+	case msgSYNACK:
+		// accepts a stream opened locally, giving its initial send window
+		if s.isLocal() && !s.isAccepted() {
+			s.acceptStream(binary.LittleEndian.Uint32(fr.payload))
+		} else {
+			s.unexpectedFrame(fr)
 		}
 
 	case msgDAT:
-		s.pushAndBroadcast(fr.payload)
+		if err := s.pushAndBroadcast(fr.payload); err != nil {
+			s.session.logger.forStream(s.id).Errorf("%v; resetting stream", err)
+			s.session.resetStream(s.id)
+			s.session.streamProtocolViolation(s.id, err)
+		} else {
+			atomic.AddUint64(&s.bytesRead, uint64(len(fr.payload)))
+		}
 
 	case msgFIN:
 		s.setRemoteClosed()
 	}
 }
 
-// onExpired is an internal helper method which sets val = true and broadcasts
-func (s *stream) onExpired(val *bool) func() {
+// unexpectedFrame resets the stream after receiving a frame which is not valid
+// in its current state, and reports the protocol violation.
+func (s *stream) unexpectedFrame(fr frame) {
+	s.session.logger.forStream(s.id).Errorf("unexpected frame %v; resetting stream", fr)
+	s.session.resetStream(s.id)
+	s.session.streamProtocolViolation(s.id, ErrUnexpectedFrame)
+}
+
+// isLocal returns true if the stream was opened by the local end, which for
+// a server session opens streams with even ids.
+func (s *stream) isLocal() bool {
+	return (s.id%2 == 0) == s.session.server
+}
+
+// onExpired is an internal helper method which sets val = true and broadcasts,
+// as long as the deadline is still t.  A timer which fires after its deadline
+// has been replaced (but before it could be stopped) has no effect.
+func (s *stream) onExpired(val *bool, deadline *time.Time, t time.Time) func() {
 	return func() {
 		s.m.Lock()
 		defer s.m.Unlock()
-		defer s.c.Broadcast()
+		if !deadline.Equal(t) {
+			return
+		}
 		*val = true
+		s.c.Broadcast()
 	}
 }
 
 // SetReadDeadline sets the read timer to the given time.  When it expires,
-// readDeadlineExceeded will be set to true.
+// readDeadlineExceeded will be set to true, and any blocked or future Read
+// calls will fail with ErrReadTimeout.  A zero value for t means Read will
+// not time out.
 //
 // This is part of the net.Conn interface.
 func (s *stream) SetReadDeadline(t time.Time) error {
@@ -154,16 +370,21 @@ func (s *stream) SetReadDeadline(t time.Time) error {
 	}
 	// clear streamDeadline exceeded
 	s.readDeadlineExceeded = false
+	s.readDeadline = t
 	if !t.IsZero() {
 		delay := time.Until(t)
-		s.readTimer = time.AfterFunc(delay, s.onExpired(&s.readDeadlineExceeded))
+		s.readTimer = time.AfterFunc(delay, s.onExpired(&s.readDeadlineExceeded, &s.readDeadline, t))
 	}
+	// wake any blocked readers so they observe the new deadline
+	s.c.Broadcast()
 
 	return nil
 }
 
 // SetWriteDeadline sets the write timer to the given time.  When it expires,
-// writeDeadlineExceeded will be set to true.
+// writeDeadlineExceeded will be set to true, and any blocked or future Write
+// calls will fail with ErrWriteTimeout.  A zero value for t means Write will
+// not time out.
 //
 // This is part of the net.Conn interface.
 func (s *stream) SetWriteDeadline(t time.Time) error {
@@ -176,10 +397,13 @@ func (s *stream) SetWriteDeadline(t time.Time) error {
 	}
 	// clear streamDeadline exceeded
 	s.writeDeadlineExceeded = false
+	s.writeDeadline = t
 	if !t.IsZero() {
 		delay := time.Until(t)
-		s.writeTimer = time.AfterFunc(delay, s.onExpired(&s.writeDeadlineExceeded))
+		s.writeTimer = time.AfterFunc(delay, s.onExpired(&s.writeDeadlineExceeded, &s.writeDeadline, t))
 	}
+	// wake any blocked writers so they observe the new deadline
+	s.c.Broadcast()
 
 	return nil
 }
@@ -189,14 +413,9 @@ func (s *stream) SetWriteDeadline(t time.Time) error {
 // This is part of the net.Conn interface.
 func (s *stream) SetDeadline(t time.Time) error {
 	if err := s.SetReadDeadline(t); err != nil {
-		s.endErr = err
 		return err
 	}
-	if err := s.SetWriteDeadline(t); err != nil {
-		s.endErr = err
-		return err
-	}
-	return nil
+	return s.SetWriteDeadline(t)
 }
 
 // unblockAndBroadcast unblocks bytes and broadcasts so that writes can
@@ -205,19 +424,40 @@ func (s *stream) unblockAndBroadcast(cap uint32) {
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
-	defer s.session.logger.Printf("unblock broadcasted : stream %d", s.id)
+	if s.session.logger.enabled(LogLevelDebug) {
+		// checked first, since boxing the arguments allocates
+		defer s.session.logger.forStream(s.id).Debugf("unblock broadcasted")
+	}
 	s.unblocked += cap
 }
 
 // pushAndBroadcast adds data to the read buffer and broadcasts so that
-// reads can continue
-func (s *stream) pushAndBroadcast(buf []byte) {
+// reads can continue.  If the data exceeds the receive window, nothing is
+// buffered and ErrWindowExceeded is returned.  Once the stream has been
+// closed for reading, data is counted against the receive window and
+// discarded.
+func (s *stream) pushAndBroadcast(buf []byte) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
-	defer s.session.logger.Printf("push broadcasted : stream %d", s.id)
-	_, err := s.b.Write(buf)
-	s.endErr = err
+	if s.session.logger.enabled(LogLevelDebug) {
+		// checked first, since boxing the arguments allocates
+		defer s.session.logger.forStream(s.id).Debugf("push broadcasted")
+	}
+	if uint64(len(buf)) > uint64(s.recvWindow) {
+		return ErrWindowExceeded
+	}
+	if s.readClosed {
+		s.recvWindow -= uint32(len(buf))
+		return nil
+	}
+	if _, err := s.b.Write(buf); err != nil {
+		s.endErr = err
+		return err
+	}
+	s.recvWindow -= uint32(len(buf))
+	s.lastActivity = s.session.clock.Now()
+	return nil
 }
 
 // acceptStream accepts the current stream, moving it to the streamAccepted
@@ -228,12 +468,25 @@ func (s *stream) acceptStream(read uint32) {
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
+	if s.state != streamCreated {
+		// the stream was closed by the remote end before it was accepted
+		return
+	}
 	s.unblocked += read
 	s.state = streamAccepted
 	close(s.accepted)
 
 }
 
+// isDrained returns true if the stream is removable, and was not killed by the
+// session closing before the remote end closed it.  Unlike isRemovable, this
+// remains accurate after the session has closed.
+func (s *stream) isDrained() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.state == streamDead && s.b.Len() == 0 && s.killErr == nil
+}
+
 // A stream is considered removable if it is in the streamDead state and its
 // read buffer has been entirely consumed.
 func (s *stream) isRemovable() bool {
@@ -242,44 +495,215 @@ func (s *stream) isRemovable() bool {
 	return s.state == streamDead && s.b.Len() == 0
 }
 
+// isRetransmittedSyn returns true if the payload of a msgSYN frame matches
+// the one which opened this remotely-initiated stream.
+func (s *stream) isRetransmittedSyn(payload []byte) bool {
+	if len(payload) < 4 || binary.LittleEndian.Uint32(payload) != s.initialSendWindow {
+		return false
+	}
+	return bytes.Equal(payload[4:], s.meta)
+}
+
+// releaseBuffer returns the stream's reserved receive window to the session,
+// when the stream is removed from the session.  It is safe to call more than
+// once.
+func (s *stream) releaseBuffer() {
+	s.m.Lock()
+	n := s.reserved
+	s.reserved = 0
+	s.bufferReleased = true
+	// a buffer still holding data may yet be read
+	if s.b.Len() == 0 {
+		s.recycleBufferLocked()
+	}
+	s.m.Unlock()
+	s.session.releaseBuffer(int64(n))
+}
+
+// recycleBufferLocked returns the stream's read buffer to the session's
+// buffer pool, if it has one, discarding any data in it, and leaves the stream
+// with an empty buffer.  The stream must no longer receive data.  The caller
+// must hold s.m.
+func (s *stream) recycleBufferLocked() {
+	pool := s.session.bufferPool
+	// buffers grown by SetReceiveWindow are not reused
+	if pool == nil || s.b.cap != s.session.streamBufferSize {
+		return
+	}
+	b := s.b
+	// data is only ever read between start and end, so resetting them is
+	// enough to prevent it leaking into another stream
+	b.start, b.end, b.empty = 0, 0, true
+	pool.Put(b)
+	s.b = newBuffer(0)
+}
+
+// isIdle returns true if the stream has been established but has had no data
+// received or written since the given time.
+func (s *stream) isIdle(since time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.state != streamCreated && s.lastActivity.Before(since)
+}
+
+// isAccepted returns true once the stream has been accepted, or has been
+// refused or reset before being accepted
+func (s *stream) isAccepted() bool {
+	select {
+	case <-s.accepted:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRefused returns true if the remote end closed the stream before accepting it.
+func (s *stream) isRefused() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.refused
+}
+
 // setRemoteClosed handles a msgFIN frame from the remote side.  If the stream
 // has been closed locally, it becomes dead; otherwise it is in state
-// streamRemoteClosed.
+// streamRemoteClosed.  A msgFIN frame for a stream which has not yet been
+// accepted indicates that the remote end refused the stream.
 func (s *stream) setRemoteClosed() {
 	s.m.Lock()
-	s.session.logger.Printf("remote stream %d closed connection", s.id)
+	s.session.logger.forStream(s.id).Debugf("remote closed connection")
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
+	if s.state == streamCreated {
+		s.refused = true
+		s.state = streamDead
+		s.cancel()
+		close(s.accepted)
+		return
+	}
 	if s.state == streamClosed {
 		s.state = streamDead
+		s.cancel()
 	} else {
 		s.state = streamRemoteClosed
 	}
 }
 
-// LocalAddr returns the local address of the underlying connection
+// reset abruptly terminates the stream, moving it to the streamDead state and
+// discarding any buffered data.  Pending and future Read and Write calls fail
+// with ErrStreamClosed.  This is used both when a msgRST frame is received and
+// when the stream is reset locally.
+func (s *stream) reset() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.c.Broadcast()
+	s.session.logger.forStream(s.id).Debugf("reset")
+	if s.state == streamCreated {
+		s.refused = true
+		close(s.accepted)
+	}
+	s.state = streamDead
+	s.cancel()
+	s.endErr = ErrStreamClosed
+	s.discardPendingLocked()
+	s.recycleBufferLocked()
+	s.b = newBuffer(0)
+}
+
+// StreamAddr is the address of one end of a stream, as returned from a
+// stream's LocalAddr and RemoteAddr methods.  It combines the address of the
+// underlying connection with the stream ID, so that streams sharing a
+// connection can be told apart.
+type StreamAddr struct {
+	// Addr is the address of the underlying connection
+	Addr net.Addr
+	// StreamID is the ID of the stream
+	StreamID uint32
+}
+
+// Network returns "wsmux"
+func (a StreamAddr) Network() string {
+	return "wsmux"
+}
+
+// String returns the address in the form ws://host:port#streamID
+func (a StreamAddr) String() string {
+	return "ws://" + a.Addr.String() + "#" + strconv.FormatUint(uint64(a.StreamID), 10)
+}
+
+// LocalAddr returns the local address of the underlying connection, with the
+// stream ID, as a StreamAddr
 //
-// This is part of the net.Conn interface.  Its value in this context is not
-// particularly useful.
+// This is part of the net.Conn interface.
 func (s *stream) LocalAddr() net.Addr {
-	return s.session.conn.LocalAddr()
+	return StreamAddr{Addr: s.session.conn.LocalAddr(), StreamID: s.id}
 }
 
-// RemoteAddr returns the remote address of the underlying connection
+// RemoteAddr returns the remote address of the underlying connection, with
+// the stream ID, as a StreamAddr
 //
-// This is part of the net.Conn interface.  Its value in this context is not
-// particularly useful.
+// This is part of the net.Conn interface.
 func (s *stream) RemoteAddr() net.Addr {
-	return s.session.conn.RemoteAddr()
+	return StreamAddr{Addr: s.session.conn.RemoteAddr(), StreamID: s.id}
 }
 
 // Close closes the stream, sending a msgFin frame unless one has already been
 // sent.  If the remote end has not closed the stream, then it will remain in
 // state streamClosed.
+//
+// Unlike CloseWrite, Close also closes the reading side: pending and future
+// reads fail with ErrStreamClosed, and data the remote end has sent, or sends
+// later, is discarded.  The stream's share of Config.MaxTotalBuffer is
+// released immediately.  Use CloseWrite for a half-close.
 func (s *stream) Close() error {
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
+	err := s.closeWriteLocked()
+	if s.endErr == nil {
+		s.endErr = ErrStreamClosed
+	}
+	s.closeReadLocked()
+	return err
+}
+
+// closeReadLocked discards unread data and the read buffer, and returns the
+// stream's reservation to the session, since the stream will not be read
+// again.  The caller must hold s.m.
+func (s *stream) closeReadLocked() {
+	if s.readClosed {
+		return
+	}
+	s.readClosed = true
+	s.recycleBufferLocked()
+	s.b = newBuffer(0)
+	n := s.reserved
+	s.reserved = 0
+	s.bufferReleased = true
+	s.session.releaseBuffer(int64(n))
+}
+
+// CloseWrite shuts down the writing side of the stream, sending a msgFIN frame
+// to indicate that no more data will be sent.  As with *net.TCPConn, reads
+// continue to return data from the remote end until it closes its side of
+// the stream, after which Read returns io.EOF.  Subsequent writes fail with
+// ErrStreamClosed.
+//
+// The msgFIN frame is written after all data from earlier writes on the
+// stream, including data queued by Config.BatchWrites, so the remote end
+// reads all of that data before io.EOF.
+func (s *stream) CloseWrite() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.c.Broadcast()
+	return s.closeWriteLocked()
+}
+
+// closeWriteLocked implements CloseWrite.  The caller must hold s.m.
+func (s *stream) closeWriteLocked() error {
+	// data held back by coalescing precedes the msgFIN frame
+	if err := s.flushPendingLocked(); err != nil {
+		return err
+	}
 
 	switch s.state {
 	// return nil if already streamClosed
@@ -289,6 +713,7 @@ func (s *stream) Close() error {
 		return nil
 	case streamRemoteClosed:
 		s.state = streamDead
+		s.cancel()
 	default:
 		s.state = streamClosed
 	}
@@ -300,20 +725,115 @@ func (s *stream) Close() error {
 	return nil
 }
 
-// Read reads bytes from the stream.  Data is acknowledged as it is received.
+// CloseWithData writes b to the stream and closes it for writing, as for
+// CloseWrite, so that the remote end reads b followed by io.EOF.  No other
+// write on the stream can come between b and the msgFIN frame, which makes
+// this suitable for sending a trailer or final message.
+//
+// b must fit in a single frame, failing with ErrFrameTooLarge otherwise.
+// CloseWithData waits until the remote end's receive window can accept all of
+// b, so b should also be no larger than that window, or the call blocks until
+// the write deadline passes.  On error, the stream is not closed.
+func (s *stream) CloseWithData(b []byte) error {
+	if len(b) > s.session.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.c.Broadcast()
+
+	for s.unblocked < uint32(len(b)) && s.endErr == nil && !s.writeDeadlineExceeded && s.state != streamClosed && s.state != streamDead {
+		s.session.logger.forStream(s.id).Debugf("close waiting")
+		s.c.Wait()
+	}
+
+	if s.killed {
+		return ErrSessionClosed
+	}
+	if s.state == streamClosed || s.state == streamDead {
+		return ErrStreamClosed
+	}
+	if s.writeDeadlineExceeded {
+		return ErrWriteTimeout
+	}
+	if s.endErr != nil {
+		return s.endErr
+	}
+
+	if err := s.flushPendingLocked(); err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		if err := s.session.sendData(newDataFrame(s.id, b), uint8(atomic.LoadUint32(&s.priority))); err != nil {
+			s.endErr = err
+			return err
+		}
+		s.unblocked -= uint32(len(b))
+		atomic.AddUint64(&s.bytesWritten, uint64(len(b)))
+		s.lastActivity = s.session.clock.Now()
+	}
+
+	// s.m is held throughout, so the msgFIN frame is queued directly after
+	// the data, and is written after it as for CloseWrite
+	return s.closeWriteLocked()
+}
+
+// CloseAndWait closes the stream for writing, as for CloseWrite, and then
+// blocks until the remote end has also closed the stream, so that the caller
+// knows the exchange on the stream is complete.  It fails with ctx.Err() if
+// the context is done first, with ErrStreamClosed if the stream is reset by
+// either end, or with ErrSessionClosed if the session closes.
+//
+// Data sent by the remote end must still be read, concurrently or
+// afterwards; the stream's window limits how much of it can be buffered, so
+// a remote end with more to send may not close its side until it is read.
+func (s *stream) CloseAndWait(ctx context.Context) error {
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+
+	// the stream's context is canceled once it is dead
+	select {
+	case <-s.Context().Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.endErr != nil {
+		return s.endErr
+	}
+	return s.killErr
+}
+
+// Read reads bytes from the stream.  Data is acknowledged as it is consumed:
+// each Read call which returns data sends a single msgACK frame covering all
+// of the bytes it returned, replenishing the remote end's send window.  ACKs
+// are thus batched per Read call, not per byte, and a Read returning no data
+// sends no ACK.  With Config.AckThreshold, ACKs are further coalesced
+// across Read calls.
 func (s *stream) Read(buf []byte) (int, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
 
 	for s.b.Len() == 0 && s.endErr == nil && !s.readDeadlineExceeded && s.state != streamRemoteClosed && s.state != streamDead {
-		s.session.logger.Printf("stream %d: read waiting", s.id)
+		s.session.logger.forStream(s.id).Debugf("read waiting")
 		// wait
 		s.c.Wait()
 	}
 
+	if s.endErr != nil {
+		return 0, s.endErr
+	}
+
 	// return EOF if buffer is empty and remote end is closed (streamRemoteClosed or streamDead)
 	if s.b.Len() == 0 && (s.state == streamRemoteClosed || s.state == streamDead) {
+		if s.killErr != nil {
+			return 0, s.killErr
+		}
 		return 0, io.EOF
 	}
 
@@ -321,25 +841,204 @@ func (s *stream) Read(buf []byte) (int, error) {
 		return 0, ErrReadTimeout
 	}
 
-	if s.endErr != nil {
-		return 0, s.endErr
-	}
-
 	n, _ := s.b.Read(buf)
 
 	// send a msgACK to indicate we received n bytes.  Note that this is not sent when we receive the
 	// msgDAT frame, but when we are about to return it to the caller; this conveys information about how
 	// quickly this process is actually consuming the data, rather than just how quickly the local TCP
 	// stack can receive it.
-	if err := s.session.send(newAckFrame(s.id, uint32(n))); err != nil {
+	if n == 0 {
+		return 0, nil
+	}
+	// once the remote end has sent msgFIN it will send no more data, so the
+	// ACK is unnecessary; the session may even have closed since, and a
+	// failure to send the ACK must not prevent draining the buffer.
+	if s.state == streamRemoteClosed || s.state == streamDead {
+		return n, nil
+	}
+	if !s.ackDueLocked() {
+		return n, nil
+	}
+	// this is normally n, but differs after the window has been resized
+	grant := s.grantLocked()
+	if grant == 0 {
+		return n, nil
+	}
+	if err := s.session.send(newAckFrame(s.id, grant)); err != nil {
 		return n, err
 	}
 
 	return n, nil
 }
 
+// grantLocked returns the additional credit to grant the remote end to bring
+// its credit plus the buffered data up to the receive window, and adds it to
+// recvWindow.  The caller must hold s.m, and send the credit in a msgACK.
+func (s *stream) grantLocked() uint32 {
+	if s.paused {
+		return 0
+	}
+	outstanding := s.recvWindow + uint32(s.b.Len())
+	if outstanding >= s.window {
+		return 0
+	}
+	grant := s.window - outstanding
+	s.recvWindow += grant
+	return grant
+}
+
+// ackDueLocked returns true if Read should send a msgACK, which is always
+// the case unless the session coalesces ACKs and the credit to be granted is
+// below the threshold.  The caller must hold s.m.
+func (s *stream) ackDueLocked() bool {
+	threshold := s.session.ackThreshold
+	if threshold == 0 {
+		return true
+	}
+	outstanding := s.recvWindow + uint32(s.b.Len())
+	if outstanding >= s.window {
+		return false
+	}
+	return float64(s.window-outstanding) >= threshold*float64(s.window)
+}
+
+// flushAck sends any credit withheld by Read while coalescing ACKs.
+func (s *stream) flushAck() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.state != streamAccepted && s.state != streamClosed {
+		return nil
+	}
+	grant := s.grantLocked()
+	if grant == 0 {
+		return nil
+	}
+	return s.session.send(newAckFrame(s.id, grant))
+}
+
+// SetReceiveWindow changes the stream's receive window, the amount of data the
+// remote end may send before the local application reads it.  The default is
+// the session's StreamBufferSize.
+//
+// The credits in msgACK frames are always additive, so the remote end needs no
+// knowledge of the window itself.  When the window grows, a msgACK frame
+// immediately grants the additional credit, and the stream's buffer grows to
+// match.  Credit which has already been granted cannot be revoked, so when
+// the window shrinks, subsequent Reads withhold ACKs until the remote end's
+// credit plus the buffered data falls within the new window.
+//
+// For a stream which has not yet been accepted, the new window takes effect
+// on the first Read.
+//
+// Growing the window fails with ErrBufferLimit if it would exceed the
+// session's Config.MaxTotalBuffer.
+func (s *stream) SetReceiveWindow(n uint32) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// the reservation only grows, since credit already granted for a larger
+	// window cannot be revoked
+	if n > s.reserved && !s.bufferReleased {
+		if !s.session.reserveBuffer(int64(n - s.reserved)) {
+			return ErrBufferLimit
+		}
+		s.reserved = n
+	}
+
+	s.window = n
+	if int(n) > s.b.cap && !s.readClosed {
+		b := newBuffer(int(n))
+		data := make([]byte, s.b.Len())
+		_, _ = s.b.Read(data)
+		_, _ = b.Write(data)
+		s.b = b
+	}
+
+	if s.state != streamAccepted && s.state != streamClosed {
+		return nil
+	}
+	grant := s.grantLocked()
+	if grant == 0 {
+		return nil
+	}
+	return s.session.send(newAckFrame(s.id, grant))
+}
+
+// setInitialWindow sets the receive window of a stream which has not yet been
+// accepted, and so has granted the remote end no credit beyond the initial
+// window, to n.  Since the remote end has not been told the initial window, it
+// may be smaller than the default.
+func (s *stream) setInitialWindow(n uint32) error {
+	if err := s.SetReceiveWindow(n); err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.recvWindow = n
+	return nil
+}
+
+// Pause stops granting the remote end credit for data which has been read,
+// collapsing the receive window so that the remote end's writes stall once the
+// credit it already holds is used up.  This is useful for rate limiting, or
+// where the data read cannot be processed until some downstream consumer
+// catches up.  Unlike simply not calling Read, the stream may continue to be
+// read while paused, so data need not be left buffered.
+//
+// Credit which has already been granted cannot be revoked, so the remote end
+// may send up to a full receive window of data after Pause.  That data is
+// within the window the stream has reserved from the session's
+// Config.MaxTotalBuffer, so pausing never increases the memory used; a paused
+// stream keeps its reservation until it is removed from the session.
+func (s *stream) Pause() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.paused = true
+}
+
+// Resume undoes Pause, sending a msgACK frame which grants the remote end
+// credit for any data read while the stream was paused, so that its writes
+// can continue.
+func (s *stream) Resume() error {
+	s.m.Lock()
+	s.paused = false
+	s.m.Unlock()
+	return s.flushAck()
+}
+
+// SendCredit returns the remaining send window: the number of bytes which may
+// be written before Write blocks until a msgACK frame from the remote end
+// grants more credit.  A stream whose transfer has stalled with SendCredit at
+// zero is waiting for the remote application to read.
+func (s *stream) SendCredit() uint32 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.unblocked
+}
+
+// ReceiveCredit returns the remaining receive window: the number of bytes the
+// remote end may send before it must wait for a msgACK frame.  This excludes
+// data already received but not yet read, so a stream whose transfer has
+// stalled with ReceiveCredit at zero is waiting for the local application to
+// read.
+func (s *stream) ReceiveCredit() uint32 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.recvWindow
+}
+
 // Write writes bytes to the stream.  This will block until the bytes have been
 // written, but not until they have been acknowledged.
+//
+// Data is never buffered beyond the remote end's receive window.  When the
+// window is exhausted, Write blocks until a msgACK frame from the remote end
+// replenishes it, the write deadline passes (returning ErrWriteTimeout), or
+// the stream or session closes.  In each case, the returned count is the
+// number of bytes sent before Write returned.
+//
+// A stream closed by the remote end with CloseWrite is only half-closed, and
+// may still be written.  Once the local end has closed the stream, or either
+// end has reset it, Write fails with ErrStreamClosed.
 func (s *stream) Write(buf []byte) (int, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
@@ -348,15 +1047,18 @@ func (s *stream) Write(buf []byte) (int, error) {
 	l, w := len(buf), 0
 	for w < l {
 		for s.unblocked == 0 && s.endErr == nil && !s.writeDeadlineExceeded && s.state != streamClosed && s.state != streamDead {
-			s.session.logger.Printf("stream %d: write waiting", s.id)
+			s.session.logger.forStream(s.id).Debugf("write waiting")
 			// wait for signal
 			s.c.Wait()
 		}
 
 		// if stream is streamClosed or waiting to be empty then abort
 		// unblocked not checked as stream can be closed, but bytes may be unblocked by remote
+		if s.killed {
+			return w, ErrSessionClosed
+		}
 		if s.state == streamClosed || s.state == streamDead {
-			return w, ErrBrokenPipe
+			return w, ErrStreamClosed
 		}
 
 		if s.writeDeadlineExceeded {
@@ -367,26 +1069,285 @@ func (s *stream) Write(buf []byte) (int, error) {
 			return w, s.endErr
 		}
 
+		if s.coalesce {
+			cap := util.Min(util.Min(len(buf), int(s.unblocked)), s.coalesceLimit()-len(s.pending))
+			s.pending = append(s.pending, buf[:cap]...)
+			buf = buf[cap:]
+			s.unblocked -= uint32(cap)
+			w += cap
+			// the window must be replenished before a blocked Write can
+			// continue, so the remote end must first receive the data
+			if len(s.pending) >= s.coalesceLimit() || s.unblocked == 0 {
+				if err := s.flushPendingLocked(); err != nil {
+					return w, err
+				}
+			} else if s.coalesceTimer == nil {
+				s.coalesceTimer = time.AfterFunc(coalesceDelay, s.onCoalesceTimer)
+			}
+			continue
+		}
+
 		// send as much data as unblocked allows; we will wait for msgACKs
 		// before sending any additional bytes.
-		cap := util.Min(len(buf), int(s.unblocked))
-		if err := s.session.send(newDataFrame(s.id, buf[:cap])); err != nil {
+		cap := util.Min(util.Min(len(buf), int(s.unblocked)), s.session.maxFrameSize)
+		if err := s.session.sendData(newDataFrame(s.id, buf[:cap]), uint8(atomic.LoadUint32(&s.priority))); err != nil {
+			// the bytes were not sent, and the stream can no longer be
+			// used reliably, so fail any further operations as well
+			s.endErr = err
 			return w, err
 		}
 		buf = buf[cap:]
 		s.unblocked -= uint32(cap)
 		w += cap
+		atomic.AddUint64(&s.bytesWritten, uint64(cap))
+		s.lastActivity = s.session.clock.Now()
 	}
 
 	return w, nil
 }
 
-// Kill forces the stream into the streamDead state.  Note that this does not send a
-// msgFIN frame, but does terminate any pending Read or Write operations.
+// ID returns the stream's ID within its session.
+func (s *stream) ID() uint32 {
+	return s.id
+}
+
+// Metadata returns the metadata attached to the stream when it was opened.
+// The returned slice must not be modified.
+func (s *stream) Metadata() []byte {
+	return s.meta
+}
+
+// Context returns the stream's context.  It carries the values of the context
+// passed to OpenContext or AcceptContext, but not its deadline or
+// cancellation, which only apply to opening or accepting the stream.  It is
+// canceled when the stream ends: when it is reset by either end, when both
+// ends have closed it, or when the session closes.  Handlers for the stream
+// can derive their own contexts from it.
+func (s *stream) Context() context.Context {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.ctx
+}
+
+// setContext replaces the stream's context with one carrying the values of
+// parent.  This must be called before the stream is returned from Open or
+// Accept.
+func (s *stream) setContext(parent context.Context) {
+	ctx, cancel := context.WithCancel(detachedContext{parent})
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.cancel()
+	s.ctx, s.cancel = ctx, cancel
+	if s.state == streamDead {
+		cancel()
+	}
+}
+
+// detachedContext carries the values of its parent context, but not its
+// deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// BytesRead returns the number of bytes of data received on this stream from
+// the remote end, including any not yet consumed by Read.
+func (s *stream) BytesRead() uint64 {
+	return atomic.LoadUint64(&s.bytesRead)
+}
+
+// BytesWritten returns the number of bytes of data written to this stream and
+// sent to the remote end.
+func (s *stream) BytesWritten() uint64 {
+	return atomic.LoadUint64(&s.bytesWritten)
+}
+
+// SetPriority sets the priority of data written to this stream, relative to
+// other streams in the same session.  When several streams have data waiting
+// to be sent, data from streams with higher priority is always sent first, so
+// a latency-sensitive stream is not delayed behind a bulk transfer.  Streams
+// of equal priority are served in order.  The change applies to subsequent
+// writes.  New streams have DefaultPriority.
+//
+// Priorities do not apply to data queued by Config.BatchWrites, which is sent
+// in the order it was written.
+func (s *stream) SetPriority(priority uint8) {
+	atomic.StoreUint32(&s.priority, uint32(priority))
+}
+
+// SetNoDelay controls whether small writes are delayed in the hope of sending
+// them together, as with Nagle's algorithm on a *net.TCPConn.  By default, as
+// for TCP connections in Go, noDelay is true and each Write is sent as soon as
+// the send window allows.  With noDelay false, written data is held for up to
+// 5ms, and sent in a single frame with any data written meanwhile, or sooner
+// once 16KiB is held or the send window is used up.  Use Flush to send held
+// data immediately.  Setting noDelay to true sends any held data.
+//
+// Held data is sent before the stream is closed with CloseWrite or
+// CloseWithData, but is discarded if the stream is reset or the session
+// closes.  An error sending held data after Write has returned is returned
+// from later writes.
+func (s *stream) SetNoDelay(noDelay bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.coalesce = !noDelay
+	if noDelay {
+		return s.flushPendingLocked()
+	}
+	return nil
+}
+
+// Flush sends any data held back from earlier writes by SetNoDelay(false).
+func (s *stream) Flush() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.flushPendingLocked()
+}
+
+// coalesceLimit returns the amount of written data held before it is sent
+func (s *stream) coalesceLimit() int {
+	return util.Min(coalesceSize, s.session.maxFrameSize)
+}
+
+// onCoalesceTimer sends held data once coalesceDelay has passed since the
+// first of it was written
+func (s *stream) onCoalesceTimer() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.coalesceTimer = nil
+	if err := s.flushPendingLocked(); err != nil {
+		s.session.logger.forStream(s.id).Errorf("error sending coalesced writes: %v", err)
+	}
+}
+
+// flushPendingLocked sends any data held back by coalescing.  As for Write,
+// an error leaves the stream unusable.  The caller must hold s.m.
+func (s *stream) flushPendingLocked() error {
+	if s.coalesceTimer != nil {
+		_ = s.coalesceTimer.Stop()
+		s.coalesceTimer = nil
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+	n := len(s.pending)
+	if err := s.session.sendData(newDataFrame(s.id, s.pending), uint8(atomic.LoadUint32(&s.priority))); err != nil {
+		s.pending = nil
+		s.endErr = err
+		return err
+	}
+	// sendData has either written the frame or copied it, so the buffer can
+	// be reused
+	s.pending = s.pending[:0]
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+	s.lastActivity = s.session.clock.Now()
+	return nil
+}
+
+// discardPendingLocked discards any data held back by coalescing, when the
+// stream can no longer send it.  The caller must hold s.m.
+func (s *stream) discardPendingLocked() {
+	if s.coalesceTimer != nil {
+		_ = s.coalesceTimer.Stop()
+		s.coalesceTimer = nil
+	}
+	s.pending = nil
+}
+
+// copyBufferPool holds buffers for WriteTo and ReadFrom, so that io.Copy to or
+// from a stream does not allocate a buffer for each call.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// WriteTo implements io.WriterTo, writing data from the stream to w until the
+// remote end closes the stream or an error occurs.
+func (s *stream) WriteTo(w io.Writer) (int64, error) {
+	bp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bp)
+	buf := *bp
+
+	var total int64
+	for {
+		n, err := s.Read(buf)
+		if n > 0 {
+			nw, ew := w.Write(buf[:n])
+			total += int64(nw)
+			if ew != nil {
+				return total, ew
+			}
+			if nw != n {
+				return total, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// ReadFrom implements io.ReaderFrom, writing data read from r to the stream
+// until r returns io.EOF or an error occurs.
+func (s *stream) ReadFrom(r io.Reader) (int64, error) {
+	bp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bp)
+	buf := *bp
+
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			nw, ew := s.Write(buf[:n])
+			total += int64(nw)
+			if ew != nil {
+				return total, ew
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Kill forces the stream into the streamDead state when the session closes.
+// Note that this does not send a msgFIN frame, but does terminate any pending
+// Read or Write operations.
 func (s *stream) kill() {
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.c.Broadcast()
-	s.session.logger.Printf("stream %d killed", s.id)
+	s.session.logger.forStream(s.id).Debugf("killed")
+	// if the remote end has not closed the stream, the data it sent may be
+	// incomplete, so reads must not end with io.EOF
+	if s.state != streamRemoteClosed && s.state != streamDead {
+		s.killErr = ErrSessionClosed
+	}
+	s.killed = true
 	s.state = streamDead
+	s.cancel()
+	s.discardPendingLocked()
 }
@@ -2,11 +2,17 @@ package wsmux
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -47,7 +53,7 @@ func TestManyStreamEchoLarge(t *testing.T) {
 			panic(err)
 		}
 
-		err = str.Close()
+		err = str.CloseWrite()
 		if err != nil {
 			panic(err)
 		}
@@ -283,7 +289,7 @@ func TestConcurrentReadAndWrite(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		err = str.Close()
+		err = str.CloseWrite()
 		if err != nil {
 			panic(err)
 		}
@@ -304,3 +310,1599 @@ func TestConcurrentReadAndWrite(t *testing.T) {
 	}
 
 }
+
+func TestDeadlineTimeoutError(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, timeoutConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{})
+	str, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a deadline in the past causes operations to fail immediately
+	_ = str.SetDeadline(time.Now().Add(-time.Second))
+	_, err = str.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("read should fail with a timeout error, got %v", err)
+	}
+	_, err = str.Write(make([]byte, 24))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("write should fail with a timeout error, got %v", err)
+	}
+}
+
+func TestReadDeadlineCleared(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, timeoutConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{})
+	errChan := make(chan error, 1)
+	str, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = str.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	go func() {
+		_, err := str.Read(make([]byte, 1))
+		errChan <- err
+	}()
+	// a zero time cancels the deadline
+	_ = str.SetReadDeadline(time.Time{})
+
+	select {
+	case err := <-errChan:
+		t.Fatalf("read should not return after deadline was cleared: %v", err)
+	case <-time.After(600 * time.Millisecond):
+	}
+	_ = client.Close()
+}
+
+func TestStreamReset(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, resetConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = str.Read(make([]byte, 1)); err != ErrStreamClosed {
+		t.Fatalf("read should fail with ErrStreamClosed, got %v", err)
+	}
+	if _, err = str.Write([]byte("Hello")); err != ErrStreamClosed {
+		t.Fatalf("write should fail with ErrStreamClosed, got %v", err)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if len(session.streams) != 0 {
+		t.Fatal("reset stream was not removed")
+	}
+}
+
+func TestWriteErrorReturned(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, timeoutConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{})
+	str, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break the underlying connection without the session's knowledge
+	_ = conn.UnderlyingConn().Close()
+
+	n, err := str.Write([]byte("Hello"))
+	if err == nil {
+		t.Fatal("write on a broken connection should fail")
+	}
+	if n != 0 {
+		t.Fatalf("write should not report bytes written, got %d", n)
+	}
+	if _, err = str.Write([]byte("Hello")); err == nil {
+		t.Fatal("subsequent writes should also fail")
+	}
+}
+
+func TestStreamBufferSizeAdvertised(t *testing.T) {
+	// timeoutConn uses a StreamBufferSize of 12
+	server := httptest.NewServer(genWebSocketHandler(t, timeoutConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{StreamBufferSize: -1})
+	if client.streamBufferSize != DefaultCapacity {
+		t.Fatalf("invalid StreamBufferSize should select the default, got %d", client.streamBufferSize)
+	}
+	str, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := str.(*stream)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.unblocked != 12 {
+		t.Fatalf("expected remote window of 12 bytes, got %d", s.unblocked)
+	}
+}
+
+func TestReceiveWindowEnforced(t *testing.T) {
+	rsts := make(chan uint32, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, genOverrunConn(rsts)))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = str.Read(make([]byte, 1)); err != ErrStreamClosed {
+		t.Fatalf("read should fail with ErrStreamClosed, got %v", err)
+	}
+
+	select {
+	case id := <-rsts:
+		if id != str.(*stream).id {
+			t.Fatalf("RST for wrong stream %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream was not reset")
+	}
+}
+
+func TestSmallWindowTransfer(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, smallWindowEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{StreamBufferSize: 16})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the transfer is far larger than the window, so it will stall unless
+	// the reader on each side acknowledges the data it consumes
+	buf := make([]byte, 64*1024)
+	for i := range buf {
+		buf[i] = byte(i % 127)
+	}
+	go func() {
+		_, _ = str.Write(buf)
+		_ = str.CloseWrite()
+	}()
+
+	_ = str.SetReadDeadline(time.Now().Add(10 * time.Second))
+	final := new(bytes.Buffer)
+	if _, err = io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, final.Bytes()) {
+		t.Fatal("bad message")
+	}
+}
+
+func TestInitialWindows(t *testing.T) {
+	windows := make(chan uint32, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{InitialReceiveWindow: 4096, InitialSendWindow: 7})
+		str, err := session.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := str.(*stream)
+		s.m.Lock()
+		windows <- s.unblocked
+		s.m.Unlock()
+	}))
+	defer server.Close()
+
+	// a session advertises its receive window in the SYN, and the accepting
+	// end advertises its own in the ACK
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, Config{InitialReceiveWindow: 100})
+	defer client.Close()
+	str, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := str.(*stream)
+	s.m.Lock()
+	if s.unblocked != 4096 {
+		t.Fatalf("expected send window of 4096 bytes, got %d", s.unblocked)
+	}
+	s.m.Unlock()
+	if w := <-windows; w != 100 {
+		t.Fatalf("expected accepted stream to have send window of 100 bytes, got %d", w)
+	}
+
+	// a SYN without a window falls back to InitialSendWindow
+	raw, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	syn := frame{id: 1, msg: msgSYN}
+	if err := raw.WriteMessage(websocket.BinaryMessage, syn.serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if w := <-windows; w != 7 {
+		t.Fatalf("expected accepted stream to have send window of 7 bytes, got %d", w)
+	}
+}
+
+func TestStreamReadFromWriteTo(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := bytes.Repeat([]byte("0123456789"), 5000)
+	n, err := str.(io.ReaderFrom).ReadFrom(bytes.NewBuffer(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(msg)) {
+		t.Fatalf("ReadFrom wrote %d bytes, expected %d", n, len(msg))
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	final := new(bytes.Buffer)
+	n, err = str.(io.WriterTo).WriteTo(final)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(msg)) || !bytes.Equal(final.Bytes(), msg) {
+		t.Fatalf("WriteTo returned %d bytes, expected %d", n, len(msg))
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := str.Write([]byte("half-closed")); err != nil {
+		t.Fatal(err)
+	}
+	cw, ok := str.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("stream does not implement CloseWrite")
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("more")); err != ErrStreamClosed {
+		t.Fatalf("expected ErrStreamClosed writing after CloseWrite, got %v", err)
+	}
+
+	// the echo arrives after the local side is closed for writing
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != "half-closed" {
+		t.Fatalf("bad message %q", final.String())
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		for {
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			// send data, but never close the stream
+			_, _ = str.Write([]byte("unread"))
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	// a Read blocked waiting for the remote end is woken by Close
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := str.Read(buf)
+		errChan <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := str.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errChan:
+		if err != ErrStreamClosed {
+			t.Fatalf("expected ErrStreamClosed from blocked read, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wake the blocked read")
+	}
+
+	// data which has arrived but not been read is not returned after Close
+	str, err = session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for str.ReceiveCredit() == DefaultCapacity {
+		if time.Now().After(deadline) {
+			t.Fatal("data did not arrive")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := str.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Read(buf); err != ErrStreamClosed {
+		t.Fatalf("expected ErrStreamClosed reading after Close, got %v", err)
+	}
+}
+
+func TestCloseWithUnreadData(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		for {
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = str.Write([]byte("unread"))
+			_ = str.Close()
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), MaxTotalBuffer: 4 * DefaultCapacity})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for str.ReceiveCredit() == DefaultCapacity {
+		if time.Now().After(deadline) {
+			t.Fatal("data did not arrive")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := str.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unread data is discarded, so the stream's window is released at
+	// once and the stream is removed once both ends have closed it
+	if n := atomic.LoadInt64(&session.reservedBuffer); n != 0 {
+		t.Fatalf("expected no reserved buffer after Close, got %d", n)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(session.StreamIDs()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream was not removed: %v", session.StreamIDs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteAfterRemoteClose(t *testing.T) {
+	t.Run("fin", func(t *testing.T) {
+		received := make(chan string, 1)
+		server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+			session := Server(conn, Config{Log: genLogger()})
+			str, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			_ = str.CloseWrite()
+			b, _ := ioutil.ReadAll(str)
+			received <- string(b)
+		}))
+		defer server.Close()
+		conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := Client(conn, Config{Log: genLogger()})
+		defer session.Close()
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the remote end has only closed its side, so writes still succeed
+		if _, err := str.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+		if _, err := str.Write([]byte("hello")); err != nil {
+			t.Fatalf("expected write to a half-closed stream to succeed, got %v", err)
+		}
+
+		// once both sides have closed, the stream is fully closed
+		_ = str.Close()
+		if _, err := str.Write([]byte("more")); err != ErrStreamClosed {
+			t.Fatalf("expected ErrStreamClosed writing after Close, got %v", err)
+		}
+		if got := <-received; got != "hello" {
+			t.Fatalf("bad message %q", got)
+		}
+	})
+
+	t.Run("rst", func(t *testing.T) {
+		server := httptest.NewServer(genWebSocketHandler(t, resetConn))
+		defer server.Close()
+		conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := Client(conn, Config{Log: genLogger()})
+		defer session.Close()
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the local end never closed the stream, but a reset closes both sides
+		<-str.Context().Done()
+		if _, err := str.Write([]byte("hello")); err != ErrStreamClosed {
+			t.Fatalf("expected ErrStreamClosed writing after reset, got %v", err)
+		}
+	})
+}
+
+func TestCloseWithData(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch=%v", batch), func(t *testing.T) {
+			server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+			defer server.Close()
+			conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := Client(conn, Config{Log: genLogger(), BatchWrites: batch, MaxFrameSize: 64})
+			defer session.Close()
+			str, err := session.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := str.CloseWithData(make([]byte, 65)); err != ErrFrameTooLarge {
+				t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+			}
+			if _, err := str.Write([]byte("body;")); err != nil {
+				t.Fatal(err)
+			}
+			if err := str.CloseWithData([]byte("trailer")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := str.Write([]byte("more")); err != ErrStreamClosed {
+				t.Fatalf("expected ErrStreamClosed writing after CloseWithData, got %v", err)
+			}
+			if err := str.CloseWithData(nil); err != ErrStreamClosed {
+				t.Fatalf("expected ErrStreamClosed, got %v", err)
+			}
+
+			// the echo server only replies once it reads io.EOF, after the
+			// final payload
+			final := new(bytes.Buffer)
+			if _, err := io.Copy(final, str); err != nil {
+				t.Fatal(err)
+			}
+			if final.String() != "body;trailer" {
+				t.Fatalf("bad message %q", final.String())
+			}
+		})
+	}
+}
+
+func TestSetNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{true, false} {
+		t.Run(fmt.Sprintf("noDelay=%v", noDelay), func(t *testing.T) {
+			server := httptest.NewServer(genWebSocketHandler(t, echoConn))
+			defer server.Close()
+			conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var frames uint32
+			session := Client(conn, Config{
+				Log: genLogger(),
+				FrameInterceptor: func(dir Direction, f FrameInfo) error {
+					if dir == Outbound && f.Type == FrameDAT {
+						atomic.AddUint32(&frames, 1)
+					}
+					return nil
+				},
+			})
+			defer session.Close()
+			str, err := session.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := str.SetNoDelay(noDelay); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if _, err := str.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// held data is sent before the msgFIN frame
+			if err := str.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			final := new(bytes.Buffer)
+			if _, err := io.Copy(final, str); err != nil {
+				t.Fatal(err)
+			}
+			if final.String() != strings.Repeat("x", 100) {
+				t.Fatalf("bad message %q", final.String())
+			}
+
+			n := atomic.LoadUint32(&frames)
+			if noDelay && n != 100 {
+				t.Fatalf("expected a frame per write, got %d", n)
+			}
+			if !noDelay && n > 10 {
+				t.Fatalf("expected writes to be coalesced, got %d frames", n)
+			}
+		})
+	}
+}
+
+func TestSetNoDelayFlush(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(str, str)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := str.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// held data is sent after a short delay, without a flush
+	if _, err := str.Write([]byte("delayed")); err != nil {
+		t.Fatal(err)
+	}
+	_ = str.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(str, buf); err != nil || string(buf) != "delayed" {
+		t.Fatalf("expected delayed data to be sent, got %q, %v", buf, err)
+	}
+
+	// Flush and SetNoDelay(true) send held data immediately
+	for _, flush := range []func() error{str.Flush, func() error { return str.SetNoDelay(true) }} {
+		if _, err := str.Write([]byte("flushed")); err != nil {
+			t.Fatal(err)
+		}
+		if err := flush(); err != nil {
+			t.Fatal(err)
+		}
+		st := str.(*stream)
+		st.m.Lock()
+		held := len(st.pending)
+		st.m.Unlock()
+		if held != 0 {
+			t.Fatalf("expected no held data, got %d bytes", held)
+		}
+		if _, err := io.ReadFull(str, buf); err != nil || string(buf) != "flushed" {
+			t.Fatalf("expected flushed data, got %q, %v", buf, err)
+		}
+		_ = str.SetNoDelay(false)
+	}
+}
+
+func TestCloseAndWait(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		// read the request on the first stream, and close it only when
+		// released
+		str, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, str)
+			<-release
+			_ = str.Close()
+		}()
+		// never close the second stream
+		if _, err := session.Accept(); err != nil {
+			return
+		}
+		<-session.Done()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := str.CloseAndWait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded before the remote end closed, got %v", err)
+	}
+
+	close(release)
+	if err := str.CloseAndWait(context.Background()); err != nil {
+		t.Fatalf("expected a full close, got %v", err)
+	}
+
+	// a stream which the remote end never closes fails when the session does
+	other, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- other.CloseAndWait(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	_ = session.Close()
+	select {
+	case err := <-done:
+		if err != ErrSessionClosed {
+			t.Fatalf("expected ErrSessionClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloseAndWait did not return when the session closed")
+	}
+}
+
+func TestReadEOFAfterFin(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, finConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait until the remote end has finished, so that reads drain the buffer
+	<-session.closed
+
+	var got []byte
+	buf := make([]byte, 3)
+	for {
+		n, err := str.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error after reading %q: %v", got, err)
+		}
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("bad message %q", got)
+	}
+	if n, err := str.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF again, got %d, %v", n, err)
+	}
+}
+
+func TestStreamPriority(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	// a saturated bulk stream does not prevent a high-priority stream from
+	// completing
+	bulk, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulk.(*stream).SetPriority(0)
+	go func() {
+		msg := make([]byte, 1024)
+		for {
+			if _, err := bulk.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	str.(*stream).SetPriority(255)
+	if _, err := str.Write([]byte("urgent")); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if final.String() != "urgent" {
+		t.Fatalf("bad message %q", final.String())
+	}
+}
+
+func TestStreamErrorsAfterSessionClose(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := str.Write([]byte("Hello")); err != ErrSessionClosed {
+		t.Fatalf("write should fail with ErrSessionClosed, got %v", err)
+	}
+	if _, err := str.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Fatalf("read should fail with ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestSessionCloseUnblocksStreams(t *testing.T) {
+	const streams = 10
+	// the remote end reads everything, but never writes
+	remoteDone := make(chan error, streams)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		for {
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, err := io.Copy(ioutil.Discard, str)
+				remoteDone <- err
+			}()
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+
+	// each stream has a reader blocked waiting for data, and a writer which
+	// writes until it fails
+	done := make(chan error, 2*streams)
+	for i := 0; i < streams; i++ {
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, err := str.Read(make([]byte, 1))
+			done <- err
+		}()
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := str.Write(buf); err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+	}
+	// let the readers and writers block
+	time.Sleep(50 * time.Millisecond)
+
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 2*streams; i++ {
+		select {
+		case err := <-done:
+			if err != ErrSessionClosed {
+				t.Fatalf("expected ErrSessionClosed, got %v", err)
+			}
+		case <-timeout:
+			t.Fatalf("%d of %d readers and writers did not return after Close", 2*streams-i, 2*streams)
+		}
+	}
+	// the remote end's readers return too, as its session closes
+	for i := 0; i < streams; i++ {
+		select {
+		case err := <-remoteDone:
+			if err == nil {
+				t.Fatal("remote reader ended with EOF, but the stream was not closed")
+			}
+		case <-timeout:
+			t.Fatalf("%d of %d remote readers did not return after Close", streams-i, streams)
+		}
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), StreamIdleTimeout: 200 * time.Millisecond})
+	defer session.Close()
+
+	idle, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := active.Write([]byte("ping")); err != nil {
+			t.Fatalf("active stream should remain open: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := idle.Write([]byte("ping")); err != ErrStreamClosed {
+		t.Fatalf("expected ErrStreamClosed on idle stream, got %v", err)
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if len(session.streams) != 1 {
+		t.Fatalf("expected only the active stream to remain, got %d streams", len(session.streams))
+	}
+}
+
+func TestStreamByteCounters(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("x"), 3000)
+	if _, err := str.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, str); err != nil {
+		t.Fatal(err)
+	}
+
+	bc, ok := str.(ByteCounter)
+	if !ok {
+		t.Fatal("stream does not implement ByteCounter")
+	}
+	if bc.BytesWritten() != 3000 || bc.BytesRead() != 3000 {
+		t.Fatalf("expected 3000 bytes each way, got read=%d written=%d", bc.BytesRead(), bc.BytesWritten())
+	}
+	if bc := other.(ByteCounter); bc.BytesWritten() != 0 || bc.BytesRead() != 0 {
+		t.Fatalf("unused stream has read=%d written=%d", bc.BytesRead(), bc.BytesWritten())
+	}
+}
+
+func TestStreamInterface(t *testing.T) {
+	accepted := make(chan uint32, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		accepted <- str.ID()
+		_ = str.Close()
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	var str Stream
+	str, err = session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str.ID()%2 != 1 {
+		t.Fatalf("client stream should have an odd ID, got %d", str.ID())
+	}
+	select {
+	case id := <-accepted:
+		if id != str.ID() {
+			t.Fatalf("accepted stream has ID %d, expected %d", id, str.ID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream not accepted")
+	}
+
+	// streams remain usable as a net.Conn
+	var _ net.Conn = str
+}
+
+func TestWriteBlocksOnWindow(t *testing.T) {
+	written := make(chan error, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.Open()
+		if err != nil {
+			written <- err
+			return
+		}
+		_, err = str.Write(bytes.Repeat([]byte("x"), 20))
+		written <- err
+		<-session.closed
+	}))
+	defer server.Close()
+
+	// speak the protocol directly on the client side, accepting the stream
+	// with a window of only 10 bytes
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readDAT := func() []byte {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr, err := deserializeFrame(msg)
+		if err != nil || fr.msg != msgDAT {
+			t.Fatalf("expected DAT frame, got %v", msg)
+		}
+		return fr.payload
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn, err := deserializeFrame(msg)
+	if err != nil || syn.msg != msgSYN {
+		t.Fatal("expected SYN frame")
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, 10).serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := readDAT(); len(p) != 10 {
+		t.Fatalf("expected 10 bytes within the window, got %d", len(p))
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("Write returned with the window exhausted: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// replenishing the window unblocks the writer
+	if err := conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, 10).serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if p := readDAT(); len(p) != 10 {
+		t.Fatalf("expected the remaining 10 bytes, got %d", len(p))
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write did not return after ACK")
+	}
+}
+
+func TestStreamCredit(t *testing.T) {
+	accepted := make(chan Stream, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		accepted <- str
+		<-session.closed
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if c := str.SendCredit(); c != DefaultCapacity {
+		t.Fatalf("expected send credit %d, got %d", DefaultCapacity, c)
+	}
+
+	if _, err := str.Write(make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if c := str.SendCredit(); c != DefaultCapacity-300 {
+		t.Fatalf("expected send credit %d after writing, got %d", DefaultCapacity-300, c)
+	}
+	waitForCredit := func(name string, credit func() uint32, want uint32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for credit() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s %d, got %d", name, want, credit())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForCredit("receive credit", remote.ReceiveCredit, DefaultCapacity-300)
+
+	// reading the data grants the credit back to the writer
+	if _, err := io.ReadFull(remote, make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if c := remote.ReceiveCredit(); c != DefaultCapacity {
+		t.Fatalf("expected receive credit %d after reading, got %d", DefaultCapacity, c)
+	}
+	waitForCredit("send credit", str.SendCredit, DefaultCapacity)
+}
+
+func TestPauseResume(t *testing.T) {
+	accepted := make(chan Stream, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		accepted <- str
+		<-session.closed
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	remote.Pause()
+
+	const size = 3 * DefaultCapacity
+	written := make(chan error, 1)
+	go func() {
+		_, err := str.Write(make([]byte, size))
+		written <- err
+	}()
+
+	// a paused stream can still be read, but the writer stalls once it has
+	// used the credit it was granted
+	if _, err := io.ReadFull(remote, make([]byte, DefaultCapacity)); err != nil {
+		t.Fatal(err)
+	}
+	if c := remote.ReceiveCredit(); c != 0 {
+		t.Fatalf("expected no receive credit while paused, got %d", c)
+	}
+	_ = remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := remote.Read(make([]byte, 1)); err != ErrReadTimeout {
+		t.Fatalf("expected the writer to stall, got %v", err)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("write completed while paused: %v", err)
+	default:
+	}
+
+	// resuming grants the credit for the data read while paused
+	_ = remote.SetReadDeadline(time.Time{})
+	if err := remote.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(remote, make([]byte, size-DefaultCapacity)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAckCoalescing(t *testing.T) {
+	const window = 1000
+	var mu sync.Mutex
+	acks := 0
+	countAcks := func(dir Direction, f FrameInfo) error {
+		if dir == Outbound && f.Type == FrameACK {
+			mu.Lock()
+			acks++
+			mu.Unlock()
+		}
+		return nil
+	}
+	sentAcks := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return acks
+	}
+
+	clock := newFakeClock()
+	accepted := make(chan Stream, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{
+			Log:              genLogger(),
+			StreamBufferSize: window,
+			AckThreshold:     0.5,
+			AckFlushInterval: time.Second,
+			FrameInterceptor: countAcks,
+			clock:            clock,
+		})
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		accepted <- str
+		<-session.closed
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), StreamBufferSize: window})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	// the ACK accepting the stream
+	base := sentAcks()
+
+	// more than the window, so the writer depends on the coalesced ACKs
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < 11; i++ {
+			if _, err := str.Write(make([]byte, 100)); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	buf := make([]byte, 100)
+	for i := 0; i < 11; i++ {
+		if _, err := io.ReadFull(remote, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	// an ACK is sent after each 500 bytes read, rather than on each Read
+	if n := sentAcks() - base; n != 2 {
+		t.Fatalf("expected 2 ACKs, got %d", n)
+	}
+	if c := remote.ReceiveCredit(); c != window-100 {
+		t.Fatalf("expected receive credit %d, got %d", window-100, c)
+	}
+
+	// the remaining credit is sent when the flush interval expires
+	deadline := time.Now().Add(5 * time.Second)
+	for remote.ReceiveCredit() != window {
+		if time.Now().After(deadline) {
+			t.Fatal("withheld credit was not flushed")
+		}
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	if n := sentAcks() - base; n != 3 {
+		t.Fatalf("expected 3 ACKs, got %d", n)
+	}
+}
+
+func TestSetReceiveWindowGrow(t *testing.T) {
+	written := make(chan error, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.Accept()
+		if err != nil {
+			written <- err
+			return
+		}
+		_, err = str.Write(bytes.Repeat([]byte("x"), 3000))
+		written <- err
+		_ = str.Close()
+		<-session.closed
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := str.SetReceiveWindow(4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole write fits in the enlarged window, without any reads
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write did not complete within the enlarged window")
+	}
+	final := new(bytes.Buffer)
+	if _, err := io.Copy(final, str); err != nil {
+		t.Fatal(err)
+	}
+	if final.Len() != 3000 {
+		t.Fatalf("expected 3000 bytes, got %d", final.Len())
+	}
+}
+
+func TestSetReceiveWindowShrink(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		if err := str.SetReceiveWindow(100); err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, str)
+	}))
+	defer server.Close()
+
+	// speak the protocol directly on the client side
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readAck := func() uint32 {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr, err := deserializeFrame(msg)
+		if err != nil || fr.msg != msgACK || fr.id != 1 {
+			t.Fatalf("expected ACK frame for stream 1, got %v", msg)
+		}
+		return binary.LittleEndian.Uint32(fr.payload)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, newSynFrame(1, DefaultCapacity, nil).serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if w := readAck(); w != DefaultCapacity {
+		t.Fatalf("expected initial window of %d, got %d", DefaultCapacity, w)
+	}
+
+	// the credit already granted can be used, but once it is consumed only
+	// the new window is granted
+	if err := conn.WriteMessage(websocket.BinaryMessage, newDataFrame(1, make([]byte, DefaultCapacity)).serialize()); err != nil {
+		t.Fatal(err)
+	}
+	granted := uint32(0)
+	for granted < 100 {
+		granted += readAck()
+	}
+	if granted != 100 {
+		t.Fatalf("expected 100 bytes of credit, got %d", granted)
+	}
+}
+
+func TestHandleAck(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str := newStream(1, session)
+	if str.isAccepted() {
+		t.Fatal("new stream should not be accepted")
+	}
+
+	// the first ACK accepts the stream
+	str.handleFrame(newAckFrame(1, 100))
+	if !str.isAccepted() || str.isRefused() {
+		t.Fatal("stream should be accepted")
+	}
+	str.m.Lock()
+	if str.state != streamAccepted || str.unblocked != 100 {
+		t.Fatalf("expected accepted stream with 100 bytes unblocked, got state %d, %d bytes", str.state, str.unblocked)
+	}
+	str.m.Unlock()
+
+	// later ACKs only add capacity
+	str.handleFrame(newAckFrame(1, 50))
+	str.m.Lock()
+	defer str.m.Unlock()
+	if str.state != streamAccepted || str.unblocked != 150 {
+		t.Fatalf("expected accepted stream with 150 bytes unblocked, got state %d, %d bytes", str.state, str.unblocked)
+	}
+}
+
+func TestReuseBuffers(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, idleConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), ReuseBuffers: true})
+	defer session.Close()
+
+	// a reset stream's buffer is recycled, discarding its data
+	str := newStream(1, session)
+	str.handleFrame(newAckFrame(1, 100))
+	str.handleFrame(newDataFrame(1, []byte("secret")))
+	str.reset()
+	str.releaseBuffer()
+	str.m.Lock()
+	if str.b.cap != 0 {
+		t.Fatal("reset stream should not keep its buffer")
+	}
+	str.m.Unlock()
+
+	// a removed stream's buffer is kept until its data has been read
+	str = newStream(3, session)
+	str.handleFrame(newAckFrame(3, 100))
+	str.handleFrame(newDataFrame(3, []byte("unread")))
+	str.releaseBuffer()
+	str.m.Lock()
+	if str.b.Len() != len("unread") {
+		t.Fatal("removed stream should keep unread data")
+	}
+	str.m.Unlock()
+
+	// new streams never see data from earlier streams
+	for i := uint32(5); i < 15; i += 2 {
+		str := newStream(i, session)
+		str.m.Lock()
+		if str.b.Len() != 0 || str.b.cap != session.streamBufferSize {
+			t.Fatalf("expected an empty buffer of %d bytes, got %d bytes of %d", session.streamBufferSize, str.b.Len(), str.b.cap)
+		}
+		str.m.Unlock()
+		str.handleFrame(newAckFrame(i, 100))
+		str.handleFrame(newDataFrame(i, []byte("data")))
+		buf := make([]byte, 10)
+		n, err := str.Read(buf)
+		if err != nil || string(buf[:n]) != "data" {
+			t.Fatalf("expected to read data, got %q, %v", buf[:n], err)
+		}
+		str.reset()
+		str.releaseBuffer()
+	}
+}
+
+func TestStreamAddr(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, acceptEchoConn))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, ok := str.LocalAddr().(StreamAddr)
+	if !ok || local.StreamID != str.ID() || local.Addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("unexpected local address %#v", str.LocalAddr())
+	}
+	if want := "ws://" + conn.RemoteAddr().String() + "#1"; str.RemoteAddr().String() != want {
+		t.Fatalf("expected remote address %q, got %q", want, str.RemoteAddr().String())
+	}
+	if str.RemoteAddr().Network() != "wsmux" {
+		t.Fatalf("unexpected network %q", str.RemoteAddr().Network())
+	}
+}
+
+type streamContextKey struct{}
+
+func TestStreamContext(t *testing.T) {
+	accepted := make(chan Stream, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		ctx := context.WithValue(context.Background(), streamContextKey{}, "server")
+		for {
+			str, err := session.AcceptContext(ctx)
+			if err != nil {
+				return
+			}
+			accepted <- str
+		}
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), streamContextKey{}, "client"))
+	str, err := session.OpenContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+
+	// the values are carried over, but not the cancellation
+	cancel()
+	if v := str.Context().Value(streamContextKey{}); v != "client" {
+		t.Fatalf("unexpected value %v in opened stream's context", v)
+	}
+	if v := remote.Context().Value(streamContextKey{}); v != "server" {
+		t.Fatalf("unexpected value %v in accepted stream's context", v)
+	}
+	if err := str.Context().Err(); err != nil {
+		t.Fatalf("stream context should not be canceled with its parent: %v", err)
+	}
+
+	// resetting the stream cancels the context at both ends
+	session.resetStream(str.ID())
+	for _, s := range []Stream{str, remote} {
+		select {
+		case <-s.Context().Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("context of stream %d was not canceled by a reset", s.ID())
+		}
+	}
+
+	// closing the session cancels the context of any remaining streams
+	str, err = session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	_ = session.Close()
+	select {
+	case <-str.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream context was not canceled by closing the session")
+	}
+}
@@ -169,3 +169,142 @@ func timeoutConn(t *testing.T, conn *websocket.Conn) {
 		t.Fatal(err)
 	}
 }
+
+// functions for keepalive test
+
+func idleConn(t *testing.T, conn *websocket.Conn) {
+	_ = Server(conn, Config{})
+}
+
+// silentConn reads from the connection without ever answering pings
+func silentConn(t *testing.T, conn *websocket.Conn) {
+	conn.SetPingHandler(func(string) error { return nil })
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// functions for stream limit test
+
+func limitedConn(t *testing.T, conn *websocket.Conn) {
+	session := Server(conn, Config{MaxStreams: 1})
+	_, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resetConn(t *testing.T, conn *websocket.Conn) {
+	session := Server(conn, Config{})
+	str, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.resetStream(str.(*stream).id)
+}
+
+// genOverrunConn returns a handler which speaks the wsmux protocol directly,
+// accepting a stream and then sending more data than the stream's window
+// allows.  Any msgRST frame received is sent to rsts.
+func genOverrunConn(rsts chan<- uint32) func(*testing.T, *websocket.Conn) {
+	return func(t *testing.T, conn *websocket.Conn) {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		syn, err := deserializeFrame(msg)
+		if err != nil || syn.msg != msgSYN {
+			t.Fatal("expected SYN frame")
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, newAckFrame(syn.id, DefaultCapacity).serialize()); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 2*DefaultCapacity)
+		if err := conn.WriteMessage(websocket.BinaryMessage, newDataFrame(syn.id, data).serialize()); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if fr, err := deserializeFrame(msg); err == nil && fr.msg == msgRST {
+				rsts <- fr.id
+			}
+		}
+	}
+}
+
+func smallWindowEchoConn(t *testing.T, conn *websocket.Conn) {
+	session := Server(conn, Config{StreamBufferSize: 16})
+	stream, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(stream, stream)
+	_ = stream.Close()
+}
+
+// closingConn closes the websocket connection with a close frame
+func closingConn(t *testing.T, conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	_ = conn.WriteMessage(websocket.CloseMessage, msg)
+}
+
+// acceptEchoConn echoes every stream until the session closes
+func acceptEchoConn(t *testing.T, conn *websocket.Conn) {
+	session := Server(conn, Config{Log: genLogger()})
+	for {
+		str, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			b := new(bytes.Buffer)
+			_, _ = io.Copy(b, str)
+			_, _ = io.Copy(str, b)
+			_ = str.Close()
+		}()
+	}
+}
+
+// finConn accepts one stream without a session, sends some data followed by
+// msgFIN, and then closes the websocket connection
+func finConn(t *testing.T, conn *websocket.Conn) {
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn, err := deserializeFrame(msg)
+	if err != nil || syn.msg != msgSYN {
+		t.Fatal("expected SYN frame")
+	}
+	for _, fr := range []frame{
+		newAckFrame(syn.id, DefaultCapacity),
+		newDataFrame(syn.id, []byte("hello")),
+		newDataFrame(syn.id, []byte(" world")),
+		newFinFrame(syn.id),
+	} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, fr.serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+}
+
+// metaConn writes the metadata of each accepted stream back to the opener
+func metaConn(t *testing.T, conn *websocket.Conn) {
+	session := Server(conn, Config{Log: genLogger()})
+	for {
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = str.Write(str.Metadata())
+			_ = str.Close()
+		}()
+	}
+}
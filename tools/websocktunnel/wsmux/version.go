@@ -0,0 +1,120 @@
+package wsmux
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ProtocolVersion is the newest version of the wsmux protocol, and thus
+	// of the frame format, supported by this package.  Version 1 is the
+	// original protocol.  Version 2 accepts streams with a msgSYNACK frame,
+	// rather than overloading the first msgACK frame.
+	ProtocolVersion uint32 = 2
+
+	// MinProtocolVersion is the oldest version of the wsmux protocol
+	// supported by this package.
+	MinProtocolVersion uint32 = 1
+
+	// CloseUnsupportedVersion is the websocket close code with which a session
+	// closes the connection when the remote end supports no protocol version
+	// in common with it; see Config.NegotiateVersion.
+	CloseUnsupportedVersion = 4001
+)
+
+// isVersionMessage returns true if msg is a version message
+func isVersionMessage(msg []byte) bool {
+	return len(msg) >= HEADER_SIZE && header(msg[:HEADER_SIZE]).msg() == msgVER
+}
+
+// newVersionMessage creates a version message advertising the given version
+func newVersionMessage(version uint32) []byte {
+	msg := append([]byte(nil), newHeader(msgVER, 0)...)
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], version)
+	return append(msg, v[:]...)
+}
+
+// Version returns the protocol version negotiated with the remote end.  This
+// is 1 until a version message is received, and remains 1 if the remote end
+// does not send one, since such a peer may predate version negotiation.
+func (s *Session) Version() uint32 {
+	return atomic.LoadUint32(&s.version)
+}
+
+// sendVersion writes the version message.  This must be the first message
+// written to the connection, so it is written before the session's goroutines
+// start.
+func (s *Session) sendVersion() error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if err := s.setWriteDeadline(); err != nil {
+		return err
+	}
+	return s.writeMessage(newVersionMessage(ProtocolVersion))
+}
+
+// handleVersion handles a version message received as the first message from
+// the remote end, selecting the newest version supported by both ends.  If
+// there is none, the connection is closed with CloseUnsupportedVersion.  A
+// session which did not advertise a version ignores the message, since the
+// remote end then assumes version 1.
+func (s *Session) handleVersion(payload []byte) {
+	if len(payload) != 4 {
+		s.logger.Errorf("discarding version message: %v", ErrMalformedFrame)
+		s.protocolViolation(ErrMalformedFrame)
+		return
+	}
+	remote := binary.LittleEndian.Uint32(payload)
+	if !s.negotiateVersion {
+		s.logger.Debugf("ignoring remote protocol version %d", remote)
+		return
+	}
+
+	version := ProtocolVersion
+	if remote < version {
+		version = remote
+	}
+	if version < MinProtocolVersion {
+		s.logger.Errorf("remote protocol version %d is not supported", remote)
+		msg := websocket.FormatCloseMessage(CloseUnsupportedVersion, ErrUnsupportedVersion.Error())
+		if err := s.writeControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+			s.logger.Errorf("could not send close message: %v", err)
+		}
+		s.abort(ErrUnsupportedVersion)
+		return
+	}
+	s.logger.Debugf("negotiated protocol version %d", version)
+	atomic.StoreUint32(&s.version, version)
+}
+
+// parseFrame parses a frame in the format of the negotiated protocol version.
+func (s *Session) parseFrame(data []byte) (frame, error) {
+	switch s.Version() {
+	case 1:
+		fr, err := deserializeFrame(data)
+		if err == nil && fr.msg == msgSYNACK {
+			// not a frame type in this version
+			return frame{}, ErrMalformedHeader
+		}
+		return fr, err
+	case 2:
+		return deserializeFrame(data)
+	default:
+		// negotiation never selects a version this package does not support
+		return frame{}, ErrUnsupportedVersion
+	}
+}
+
+// newAcceptFrame creates the frame which accepts a stream opened by the remote
+// end, giving the local end's initial receive window: a msgSYNACK frame, or in
+// version 1, a msgACK frame.
+func (s *Session) newAcceptFrame(id uint32, window uint32) frame {
+	if s.Version() < 2 {
+		return newAckFrame(id, window)
+	}
+	return newSynAckFrame(id, window)
+}
@@ -0,0 +1,324 @@
+package wsmux
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/util"
+)
+
+func TestVersionNegotiation(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), NegotiateVersion: true})
+		str, err := session.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(str, str)
+		_ = str.Close()
+	}))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), NegotiateVersion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	str, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected echo, got %q", buf)
+	}
+	if v := session.Version(); v != ProtocolVersion {
+		t.Fatalf("expected version %d, got %d", ProtocolVersion, v)
+	}
+}
+
+// versionPeer returns a handler which advertises the given protocol version,
+// and reports the first message and close code it receives
+func versionPeer(version uint32, first chan<- []byte, closed chan<- int) func(*testing.T, *websocket.Conn) {
+	return func(t *testing.T, conn *websocket.Conn) {
+		if err := conn.WriteMessage(websocket.BinaryMessage, newVersionMessage(version)); err != nil {
+			return
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				code := 0
+				if ce, ok := err.(*websocket.CloseError); ok {
+					code = ce.Code
+				}
+				closed <- code
+				return
+			}
+			select {
+			case first <- msg:
+			default:
+			}
+		}
+	}
+}
+
+func TestVersionNewerPeer(t *testing.T) {
+	first := make(chan []byte, 1)
+	closed := make(chan int, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, versionPeer(7, first, closed)))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), NegotiateVersion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// the version message is sent before anything else
+	msg := <-first
+	if !isVersionMessage(msg) {
+		t.Fatalf("expected a version message first, got %v", msg)
+	}
+
+	// the peer's newer version is negotiated down to ours
+	deadline := time.Now().Add(5 * time.Second)
+	for session.Version() != ProtocolVersion {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected version %d, got %d", ProtocolVersion, session.Version())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if session.IsClosed() {
+		t.Fatal("session closed with a compatible peer")
+	}
+}
+
+func TestVersionUnsupported(t *testing.T) {
+	first := make(chan []byte, 1)
+	closed := make(chan int, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, versionPeer(0, first, closed)))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), NegotiateVersion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not close")
+	}
+	if err := session.Err(); err != ErrUnsupportedVersion {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if code := <-closed; code != CloseUnsupportedVersion {
+		t.Fatalf("expected close code %d, got %d", CloseUnsupportedVersion, code)
+	}
+}
+
+func TestVersionRejectedByPeer(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		msg := websocket.FormatCloseMessage(CloseUnsupportedVersion, "unsupported protocol version")
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{Log: genLogger(), NegotiateVersion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not close")
+	}
+	if err := session.Err(); err != ErrUnsupportedVersion {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestVersionIgnoredWithoutNegotiation(t *testing.T) {
+	first := make(chan []byte, 1)
+	closed := make(chan int, 1)
+	server := httptest.NewServer(genWebSocketHandler(t, versionPeer(0, first, closed)))
+	defer server.Close()
+	violations := make(chan error, 1)
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+		Log:             genLogger(),
+		StrictProtocol:  true,
+		OnProtocolError: func(err error) { violations <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// allow time for the version message to arrive
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-violations:
+		t.Fatalf("unexpected protocol violation: %v", err)
+	default:
+	}
+	if session.IsClosed() {
+		t.Fatal("session closed")
+	}
+	if v := session.Version(); v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
+func TestVersionMessageAfterFirst(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		for _, msg := range [][]byte{newRstFrame(2).serialize(), newVersionMessage(1)} {
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	violations := make(chan error, 1)
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+		Log:              genLogger(),
+		NegotiateVersion: true,
+		OnProtocolError:  func(err error) { violations <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	select {
+	case err := <-violations:
+		if err.(*ProtocolError).Kind != ErrMalformedHeader {
+			t.Fatalf("expected ErrMalformedHeader, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a late version message should be a protocol violation")
+	}
+}
+
+func TestVersionSynAck(t *testing.T) {
+	for _, negotiate := range []bool{false, true} {
+		server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+			session := Server(conn, Config{Log: genLogger(), NegotiateVersion: negotiate})
+			str, err := session.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(str, str)
+			_ = str.Close()
+		}))
+		violations := make(chan error, 1)
+		session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+			Log:              genLogger(),
+			NegotiateVersion: negotiate,
+			StrictProtocol:   true,
+			OnProtocolError:  func(err error) { violations <- err },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		str, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := str.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(str, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		// streams are accepted with a msgSYNACK only once version 2 is
+		// negotiated
+		frames := session.Stats().FramesReceived
+		if negotiate && (frames.SYNACK != 1 || session.Version() != 2) {
+			t.Fatalf("expected one SYNACK with version 2, got %+v with version %d", frames, session.Version())
+		}
+		if !negotiate && (frames.SYNACK != 0 || frames.ACK == 0) {
+			t.Fatalf("expected only ACKs with version 1, got %+v", frames)
+		}
+		select {
+		case err := <-violations:
+			t.Fatalf("unexpected protocol violation: %v", err)
+		default:
+		}
+
+		_ = session.Close()
+		server.Close()
+	}
+}
+
+func TestVersionUnexpectedSynAck(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		if err := conn.WriteMessage(websocket.BinaryMessage, newVersionMessage(ProtocolVersion)); err != nil {
+			return
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if isVersionMessage(msg) {
+				continue
+			}
+			// accept each stream twice
+			fr, err := deserializeFrame(msg)
+			if err != nil || fr.msg != msgSYN {
+				continue
+			}
+			for i := 0; i < 2; i++ {
+				if err := conn.WriteMessage(websocket.BinaryMessage, newSynAckFrame(fr.id, 1024).serialize()); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	defer server.Close()
+	violations := make(chan error, 1)
+	session, err := Dial(context.Background(), util.MakeWsURL(server.URL), Config{
+		Log:              genLogger(),
+		NegotiateVersion: true,
+		OnProtocolError:  func(err error) { violations <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-violations:
+		if err.(*ProtocolError).Kind != ErrUnexpectedFrame {
+			t.Fatalf("expected ErrUnexpectedFrame, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a second SYNACK should be a protocol violation")
+	}
+}
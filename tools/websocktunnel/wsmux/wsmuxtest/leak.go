@@ -0,0 +1,44 @@
+package wsmuxtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/wsmux"
+)
+
+// leakTimeout is how long AssertNoLeakedStreams waits for streams to be
+// removed and for the session's goroutines to exit.  Sessions remove streams
+// closed by both ends periodically, every two seconds, so this must be longer
+// than that.
+var leakTimeout = 5 * time.Second
+
+// AssertNoLeakedStreams checks that the session tracks no streams, and that
+// its goroutines exit once it is closed, failing the test otherwise.  Streams
+// which both ends have closed are not removed from a session immediately, so
+// this waits for a few seconds for the session to remove them before failing.
+//
+// Call it at the end of a test, once the test has finished with the session's
+// streams, for example with defer.  It closes the session.
+func AssertNoLeakedStreams(t testing.TB, s *wsmux.Session) {
+	t.Helper()
+
+	deadline := time.Now().Add(leakTimeout)
+	for s.NumStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids := s.StreamIDs(); len(ids) > 0 {
+		t.Errorf("wsmuxtest: session has %d leaked streams: %v", len(ids), ids)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = s.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(leakTimeout):
+		t.Errorf("wsmuxtest: session goroutines did not exit after it was closed")
+	}
+}
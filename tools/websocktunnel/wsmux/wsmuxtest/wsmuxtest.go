@@ -0,0 +1,155 @@
+// Package wsmuxtest provides utilities for testing code which uses wsmux
+// sessions, without using the network.
+package wsmuxtest
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/wsmux"
+)
+
+// NewSessionPair creates a client and a server session connected to each
+// other in-process, over an in-memory websocket connection.  Streams opened
+// on either session are accepted on the other.  Both sessions use conf; the
+// caller should close both when done.  NewSessionPair panics if the websocket
+// handshake fails.
+func NewSessionPair(conf wsmux.Config) (client, server *wsmux.Session) {
+	clientConn, serverConn := newBufferedPipe()
+
+	type result struct {
+		conn *websocket.Conn
+		err  error
+	}
+	upgraded := make(chan result, 1)
+	go func() {
+		conn, err := upgrade(serverConn, conf.EnableCompression)
+		upgraded <- result{conn, err}
+	}()
+
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return clientConn, nil
+		},
+		EnableCompression: conf.EnableCompression,
+	}
+	clientWs, _, err := dialer.Dial("ws://wsmuxtest/", nil)
+	if err != nil {
+		panic("wsmuxtest: dialing: " + err.Error())
+	}
+	res := <-upgraded
+	if res.err != nil {
+		panic("wsmuxtest: upgrading: " + res.err.Error())
+	}
+
+	return wsmux.Client(clientWs, conf), wsmux.Server(res.conn, conf)
+}
+
+// upgrade reads a websocket handshake request from conn and upgrades it
+func upgrade(conn net.Conn, enableCompression bool) (*websocket.Conn, error) {
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	req, err := http.ReadRequest(brw.Reader)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	upgrader := websocket.Upgrader{EnableCompression: enableCompression}
+	w := &hijackWriter{conn: conn, brw: brw, header: make(http.Header)}
+	return upgrader.Upgrade(w, req, nil)
+}
+
+// hijackWriter is a minimal http.ResponseWriter for a connection which is
+// hijacked by the websocket upgrader
+type hijackWriter struct {
+	conn   net.Conn
+	brw    *bufio.ReadWriter
+	header http.Header
+}
+
+func (w *hijackWriter) Header() http.Header {
+	return w.header
+}
+
+// Write and WriteHeader are only used by the upgrader to report errors, which
+// are returned from Upgrade anyway
+func (w *hijackWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *hijackWriter) WriteHeader(statusCode int) {
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, w.brw, nil
+}
+
+// newBufferedPipe returns a pair of connected net.Conns, like net.Pipe, but
+// where writes complete without waiting for the other end to read.  Sessions
+// need this, since both ends may write at the same time as each other, for
+// example from their receive loops.
+//
+// Each end is itself one end of a net.Pipe, so that deadlines and Close
+// behave as usual; data is relayed between the pipes through an unbounded
+// buffer.
+func newBufferedPipe() (net.Conn, net.Conn) {
+	a, aInner := net.Pipe()
+	b, bInner := net.Pipe()
+	go relay(aInner, bInner)
+	go relay(bInner, aInner)
+	return a, b
+}
+
+// relay copies data from src to dst, buffering as much data as is written to
+// src.  When src is closed, dst is closed once the buffered data is written.
+func relay(src, dst net.Conn) {
+	var (
+		mu   sync.Mutex
+		cond = sync.NewCond(&mu)
+		buf  []byte
+		eof  bool
+	)
+
+	go func() {
+		defer func() {
+			// unblock the reader goroutine when dst fails
+			_ = src.Close()
+		}()
+		for {
+			mu.Lock()
+			for len(buf) == 0 && !eof {
+				cond.Wait()
+			}
+			if len(buf) == 0 {
+				mu.Unlock()
+				_ = dst.Close()
+				return
+			}
+			data := buf
+			buf = nil
+			mu.Unlock()
+
+			if _, err := dst.Write(data); err != nil {
+				_ = dst.Close()
+				return
+			}
+		}
+	}()
+
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(chunk)
+		mu.Lock()
+		buf = append(buf, chunk[:n]...)
+		if err != nil {
+			eof = true
+		}
+		cond.Signal()
+		mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package wsmuxtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taskcluster/taskcluster/v42/tools/websocktunnel/wsmux"
+)
+
+// echo accepts streams on session, echoing their data back
+func echo(session *wsmux.Session) {
+	for {
+		str, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(str, str)
+			_ = str.Close()
+		}()
+	}
+}
+
+func TestNewSessionPair(t *testing.T) {
+	client, server := NewSessionPair(wsmux.Config{})
+	defer client.Close()
+	defer server.Close()
+	go echo(server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			str, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data := bytes.Repeat([]byte("wsmux"), 10000)
+			go func() {
+				_, _ = str.Write(data)
+				_ = str.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(str)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, expected %d", len(got), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// streams can also be opened by the server
+	go echo(client)
+	str, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(str, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected read %q, %v", buf, err)
+	}
+}
+
+func TestNewSessionPairClose(t *testing.T) {
+	client, server := NewSessionPair(wsmux.Config{})
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AcceptStream(); err == nil {
+		t.Fatal("expected Accept to fail once the client closed")
+	}
+	if !server.IsClosed() {
+		t.Fatal("server should close when the client closes")
+	}
+}
+
+func BenchmarkSessionPair(b *testing.B) {
+	client, server := NewSessionPair(wsmux.Config{})
+	defer client.Close()
+	defer server.Close()
+	go echo(server)
+
+	str, err := client.Open()
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 16*1024)
+	buf := make([]byte, len(data))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	// the echoed data must be read concurrently, as it is written, since the
+	// stream windows are smaller than the data
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := str.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(str, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// errorRecorder records errors reported to a testing.TB, without failing the
+// test
+type errorRecorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *errorRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertNoLeakedStreams(t *testing.T) {
+	client, server := NewSessionPair(wsmux.Config{})
+	defer server.Close()
+	go echo(server)
+
+	str, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(str); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream is closed by both ends, so is removed from the session
+	rec := &errorRecorder{TB: t}
+	AssertNoLeakedStreams(rec, client)
+	if len(rec.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", rec.errors)
+	}
+	if !client.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+}
+
+func TestAssertNoLeakedStreamsLeak(t *testing.T) {
+	defer func(d time.Duration) { leakTimeout = d }(leakTimeout)
+	leakTimeout = 100 * time.Millisecond
+
+	client, server := NewSessionPair(wsmux.Config{})
+	defer server.Close()
+	go echo(server)
+
+	// the stream is never closed
+	if _, err := client.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &errorRecorder{TB: t}
+	AssertNoLeakedStreams(rec, client)
+	if len(rec.errors) != 1 || !strings.Contains(rec.errors[0], "1 leaked streams: [1]") {
+		t.Fatalf("expected a leaked stream to be reported, got %v", rec.errors)
+	}
+}